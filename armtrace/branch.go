@@ -0,0 +1,245 @@
+// Package armtrace holds the packet layouts shared by the PTM (PFTv1.x) and
+// ETMv3 protocols: branch addresses, I-sync and the address state they drive.
+package armtrace
+
+import (
+	"fmt"
+
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type ISA uint8
+
+const (
+	ISA_ARM ISA = iota
+	ISA_THUMB
+	ISA_JAZELLE
+)
+
+// BranchAddr is the address and exception information of a Branch Address
+// packet.
+type BranchAddr struct {
+	field      uint64
+	bits       uint
+	isa_valid  bool
+	isa        ISA
+	excp_valid bool
+	excp       uint16
+	ns         bool
+	hyp        bool
+	alt_isa    bool
+	cancel     bool
+}
+
+// SyncPacket is an I-sync packet, giving the full address and instruction set.
+type SyncPacket interface {
+	pkts.TracePacket
+	Address() uint64
+	ISA() ISA
+}
+
+// BranchPacket is a packet carrying a compressed branch target.
+type BranchPacket interface {
+	pkts.TracePacket
+	Branch() BranchAddr
+}
+
+// WaypointPacket is a BranchPacket moving the address to a waypoint rather
+// than the target of a taken branch.
+type WaypointPacket interface {
+	BranchPacket
+	Waypoint()
+}
+
+// AddressState tracks the current instruction address and instruction set
+// needed to resolve compressed branch addresses.
+type AddressState struct {
+	Address uint64
+	ISA     ISA
+}
+
+// DecodeAddress reads up to five address bytes starting with the header.
+// The header carries six address bits and each continuation byte seven, the
+// fifth byte indicates the instruction set and the remaining high bits.
+func DecodeAddress(header byte, reader *pkts.Reader) (BranchAddr, error) {
+	addr := BranchAddr{field: uint64(header>>1) & 0x3f, bits: 6}
+
+	addr_byte := header
+	for i := 1; i < 4 && addr_byte&0x80 == 0x80; i++ {
+		var err error
+		addr_byte, err = reader.ReadByte()
+		if err != nil {
+			return addr, err
+		}
+		addr.field |= uint64(addr_byte&0x7f) << addr.bits
+		addr.bits += 7
+	}
+
+	if addr_byte&0x80 == 0 {
+		return addr, nil
+	}
+
+	last_byte, err := reader.ReadByte()
+	if err != nil {
+		return addr, err
+	}
+
+	addr.isa_valid = true
+	switch {
+	case last_byte&0x20 == 0x20:
+		addr.isa = ISA_JAZELLE
+		addr.field |= uint64(last_byte&0x1f) << addr.bits
+		addr.bits += 5
+	case last_byte&0x10 == 0x10:
+		addr.isa = ISA_THUMB
+		addr.field |= uint64(last_byte&0x0f) << addr.bits
+		addr.bits += 4
+	default:
+		addr.isa = ISA_ARM
+		addr.field |= uint64(last_byte&0x07) << addr.bits
+		addr.bits += 3
+	}
+	addr.excp_valid = last_byte&0x40 == 0x40
+
+	return addr, nil
+}
+
+// DecodeBranchAddr reads a Branch Address packet, including the exception
+// information bytes that follow a full address.  Errors are those of the
+// reader, for the caller to wrap.
+func DecodeBranchAddr(header byte, reader *pkts.Reader) (BranchAddr, error) {
+	addr, err := DecodeAddress(header, reader)
+	if err != nil || !addr.excp_valid {
+		return addr, err
+	}
+
+	info0, err := reader.ReadByte()
+	if err != nil {
+		return addr, err
+	}
+
+	addr.ns = info0&0x1 == 0x1
+	addr.excp = uint16(info0>>1) & 0xf
+	addr.cancel = info0&0x20 == 0x20
+	addr.alt_isa = info0&0x40 == 0x40
+
+	if info0&0x80 == 0x80 {
+		info1, err := reader.ReadByte()
+		if err != nil {
+			return addr, err
+		}
+		addr.excp |= uint16(info1&0x1f) << 4
+		addr.hyp = info1&0x20 == 0x20
+	}
+	return addr, nil
+}
+
+func (isa ISA) String() string {
+	switch isa {
+	case ISA_ARM:
+		return "ARM"
+	case ISA_THUMB:
+		return "Thumb"
+	case ISA_JAZELLE:
+		return "Jazelle"
+	}
+	return fmt.Sprintf("ISA(%d)", uint8(isa))
+}
+
+// shift returns the number of always-zero low address bits for the ISA.
+func (isa ISA) shift() uint {
+	switch isa {
+	case ISA_ARM:
+		return 2
+	case ISA_THUMB:
+		return 1
+	}
+	return 0
+}
+
+// Branch returns the address fields, letting packets embedding a BranchAddr
+// satisfy BranchPacket.
+func (addr BranchAddr) Branch() BranchAddr {
+	return addr
+}
+
+// AddrWithBase resolves the branch target against the previous address using
+// the instruction set in effect at the branch.
+func (addr BranchAddr) AddrWithBase(base uint64, isa ISA) uint64 {
+	if addr.isa_valid {
+		isa = addr.isa
+	}
+
+	width := addr.bits + isa.shift()
+	if width >= 32 {
+		return (addr.field << isa.shift()) & 0xffffffff
+	}
+
+	mask := uint64(1)<<width - 1
+	return (base &^ mask) | (addr.field << isa.shift())
+}
+
+// ISA returns the instruction set of the branch target and whether the packet
+// changed it.
+func (addr BranchAddr) ISA() (ISA, bool) {
+	return addr.isa, addr.isa_valid
+}
+
+func (addr BranchAddr) Exception() (uint16, bool) {
+	return addr.excp, addr.excp_valid
+}
+
+// Bits returns the address field carried by the packet and how many of its
+// bits are valid, before they're combined with the current address.
+func (addr BranchAddr) Bits() (uint64, uint) {
+	return addr.field, addr.bits
+}
+
+func (addr BranchAddr) NS() bool {
+	return addr.ns
+}
+
+func (addr BranchAddr) Hyp() bool {
+	return addr.hyp
+}
+
+func (addr BranchAddr) AltISA() bool {
+	return addr.alt_isa
+}
+
+// Cancel reports whether the branch cancelled the last traced instruction.
+// Only ETMv3 defines the bit, PTM reserves it.
+func (addr BranchAddr) Cancel() bool {
+	return addr.cancel
+}
+
+// Update applies an address carrying packet to the state and returns a
+// description of the resolved address.
+func (s *AddressState) Update(pkt pkts.TracePacket) string {
+	switch addr_pkt := pkt.(type) {
+	case SyncPacket:
+		s.Address = addr_pkt.Address()
+		s.ISA = addr_pkt.ISA()
+		return pkt.String()
+
+	case WaypointPacket:
+		s.branch(addr_pkt.Branch())
+		return fmt.Sprintf("Waypoint %s Address = 0x%08x", s.ISA, s.Address)
+
+	case BranchPacket:
+		addr := addr_pkt.Branch()
+		s.branch(addr)
+		if excp, ok := addr.Exception(); ok {
+			return fmt.Sprintf("%s Address = 0x%08x Exception: %d", s.ISA, s.Address, excp)
+		}
+		return fmt.Sprintf("%s Address = 0x%08x", s.ISA, s.Address)
+	}
+	return pkt.String()
+}
+
+func (s *AddressState) branch(addr BranchAddr) {
+	s.Address = addr.AddrWithBase(s.Address, s.ISA)
+	if isa, ok := addr.ISA(); ok {
+		s.ISA = isa
+	}
+}
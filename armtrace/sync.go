@@ -0,0 +1,204 @@
+package armtrace
+
+import (
+	"bytes"
+	"fmt"
+
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Number of CONTEXTID bytes traced, set by ETMCR.ContextIDSize
+const (
+	CONTEXTID_BYTES = 4
+)
+
+// A-sync is five 0x00 bytes followed by 0x80
+const (
+	ASYNC_ZEROS = 5
+)
+
+// ISync is the payload of an I-sync packet.  The fields are read in the order
+// the protocol sends them, with ReadAddress, ReadInfo and ReadContextID.
+type ISync struct {
+	address uint64
+	isa     ISA
+	reason  uint8
+	ns      bool
+	alt_isa bool
+	hyp     bool
+	cid     uint32
+}
+
+var isyncReasons = [...]string{
+	"Periodic",
+	"Trace On",
+	"Trace Restart",
+	"Debug Exit",
+}
+
+// ReadAsync reads the rest of an A-sync packet after its first 0x00 header.
+func ReadAsync(header byte, reader *pkts.Reader) error {
+	for i := 1; i < ASYNC_ZEROS; i++ {
+		next_byte, err := reader.ReadByte()
+		if err != nil {
+			return &pkts.TruncatedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: "A-sync", Err: err}
+		}
+		if next_byte != 0x00 {
+			return &pkts.MalformedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: "A-sync", Reason: fmt.Sprintf("unexpected byte 0x%02x", next_byte)}
+		}
+	}
+
+	last_byte, err := reader.ReadByte()
+	if err != nil {
+		return &pkts.TruncatedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: "A-sync", Err: err}
+	}
+	if last_byte != 0x80 {
+		return &pkts.MalformedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: "A-sync", Reason: fmt.Sprintf("unexpected terminator 0x%02x", last_byte)}
+	}
+	return nil
+}
+
+// ReadContextID reads a little-endian CONTEXTID of CONTEXTID_BYTES bytes.
+func ReadContextID(reader *pkts.Reader) (uint32, error) {
+	var cid uint32
+	for i := 0; i < CONTEXTID_BYTES; i++ {
+		cid_byte, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		cid |= uint32(cid_byte) << uint(8*i)
+	}
+	return cid, nil
+}
+
+// ReadCycleCount reads a cycle count of up to 5 continuation bytes.
+func ReadCycleCount(reader *pkts.Reader) (uint32, error) {
+	var count uint32
+	for i := 0; i < 5; i++ {
+		count_byte, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		count |= uint32(count_byte&0x7f) << uint(7*i)
+		if count_byte&0x80 == 0 {
+			break
+		}
+	}
+	return count, nil
+}
+
+// ReadTimestamp reads a timestamp of up to 9 bytes, the last holding a full
+// 8 bits.
+func ReadTimestamp(reader *pkts.Reader) (uint64, error) {
+	var timestamp uint64
+	for i := 0; i < 9; i++ {
+		ts_byte, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if i == 8 {
+			timestamp |= uint64(ts_byte) << 56
+			break
+		}
+
+		timestamp |= uint64(ts_byte&0x7f) << uint(7*i)
+		if ts_byte&0x80 == 0 {
+			break
+		}
+	}
+	return timestamp, nil
+}
+
+// ReadAddress reads the 4 address bytes.  Bit[0] of the address is the Thumb
+// state unless jazelle, when it's part of the address.
+func (s *ISync) ReadAddress(reader *pkts.Reader, jazelle bool) error {
+	s.address = 0
+	for i := 0; i < 4; i++ {
+		addr_byte, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		s.address |= uint64(addr_byte) << uint(8*i)
+	}
+
+	switch {
+	case jazelle:
+		s.isa = ISA_JAZELLE
+	case s.address&0x1 == 0x1:
+		s.isa = ISA_THUMB
+		s.address &^= 0x1
+	default:
+		s.isa = ISA_ARM
+	}
+	return nil
+}
+
+// ReadInfo reads the information byte, returning it for the bits only one
+// protocol defines.
+func (s *ISync) ReadInfo(reader *pkts.Reader) (byte, error) {
+	info, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	s.reason = uint8(info>>5) & 0x3
+	s.ns = info&0x08 == 0x08
+	s.alt_isa = info&0x04 == 0x04
+	s.hyp = info&0x02 == 0x02
+	return info, nil
+}
+
+func (s *ISync) ReadContextID(reader *pkts.Reader) error {
+	cid, err := ReadContextID(reader)
+	s.cid = cid
+	return err
+}
+
+func (s ISync) Address() uint64 {
+	return s.address
+}
+
+func (s ISync) ISA() ISA {
+	return s.isa
+}
+
+func (s ISync) NS() bool {
+	return s.ns
+}
+
+func (s ISync) ContextID() uint32 {
+	return s.cid
+}
+
+func (s ISync) Reason() uint8 {
+	return s.reason
+}
+
+func (s ISync) AltISA() bool {
+	return s.alt_isa
+}
+
+func (s ISync) Hyp() bool {
+	return s.hyp
+}
+
+func (s ISync) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("I-sync: %s Address = 0x%08x Reason: %s NS: %t", s.isa, s.address, isyncReasons[s.reason], s.ns))
+
+	if s.alt_isa {
+		buffer.WriteString(" AltISA")
+	}
+
+	if s.hyp {
+		buffer.WriteString(" Hyp")
+	}
+
+	if CONTEXTID_BYTES > 0 {
+		buffer.WriteString(fmt.Sprintf(" CID: %x", s.cid))
+	}
+	return buffer.String()
+}
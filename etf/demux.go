@@ -0,0 +1,362 @@
+package etf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Demuxer splits an Embedded Trace FIFO formatter stream into the trace of
+// each source.  Frames are only read from the input as data is asked for, so
+// arbitrarily large dumps are processed in constant memory.
+type Demuxer struct {
+	in         *bufio.Reader
+	pending    []byte
+	frame      []byte
+	cur_id     uint64
+	streams    map[uint64]*Stream
+	counts     map[uint64]int64
+	triggers   []Trigger
+	err        error
+	frame_sync bool
+	synced     bool
+	sync_lost  func(offset int64)
+	offset     int64
+	frame_off  int64
+}
+
+// Stream is the trace of a single trace ID within a Demuxer.
+type Stream struct {
+	id    uint64
+	demux *Demuxer
+	buf   []byte
+	total int64
+}
+
+// Trigger is a trigger marker the formatter inserted into the trace, as when
+// a CTI fired.
+type Trigger struct {
+	offset    int64
+	value     byte
+	positions map[uint64]int64
+}
+
+// Formatter IDs that aren't trace sources
+const (
+	NULL_ID    = 0x00
+	TRIGGER_ID = 0x7d
+)
+
+// Full frame sync, the 32-bit word 0x7fffffff inserted between frames on a
+// TPIU port
+var FSYNC = []byte{0xff, 0xff, 0xff, 0x7f}
+
+// Half-word sync, the 16-bit word 0x7fff padding a frame on a TPIU port
+var HSYNC = []byte{0xff, 0x7f}
+
+func NewDemuxer(in io.Reader) *Demuxer {
+	log.Debugln("Creating new ETF Demuxer")
+	return &Demuxer{
+		in:      bufio.NewReader(in),
+		frame:   make([]byte, recordLen),
+		streams: make(map[uint64]*Stream),
+		counts:  make(map[uint64]int64),
+	}
+}
+
+// NewTPIUDemuxer returns a Demuxer for a TPIU port capture, which may start
+// mid-frame and carries frame and half-word syncs.  Decoding starts after the
+// first full frame sync, and all syncs are stripped.
+func NewTPIUDemuxer(in io.Reader) *Demuxer {
+	d := NewDemuxer(in)
+	d.frame_sync = true
+	return d
+}
+
+// OnSyncLost sets fn to be called with the input offset of each frame sync
+// found inside a frame of a TPIU capture.  The frame is dropped and decoding
+// restarts after the sync.
+func (d *Demuxer) OnSyncLost(fn func(offset int64)) {
+	d.sync_lost = fn
+}
+
+// Stream returns a reader for the trace of id.  Data for IDs without a Stream
+// is discarded, so every Stream of interest should be created before reading.
+func (d *Demuxer) Stream(id uint64) *Stream {
+	if d.streams[id] == nil {
+		d.streams[id] = &Stream{id: id, demux: d}
+	}
+	return d.streams[id]
+}
+
+// Each calls fn with every run of bytes for a single ID, in stream order,
+// until the input is exhausted.  data is only valid during the call.
+func (d *Demuxer) Each(fn func(id uint64, data []byte)) error {
+	var run []byte
+	var run_id uint64
+
+	for {
+		err := d.nextFrame(func(id uint64, b byte) {
+			if len(run) > 0 && id != run_id {
+				fn(run_id, run)
+				run = run[:0]
+			}
+			run_id = id
+			run = append(run, b)
+		})
+		if len(run) > 0 {
+			fn(run_id, run)
+			run = run[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// IDs returns the trace IDs that have carried data so far.
+func (d *Demuxer) IDs() []uint64 {
+	ids := make([]uint64, 0, len(d.counts))
+	for id := range d.counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// nextFrame reads one formatter frame and passes each data byte to emit along
+// with the ID it belongs to.
+func (d *Demuxer) nextFrame(emit func(id uint64, b byte)) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	err := d.readFrame()
+	if err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("Error received reading input file: %q", err)
+	}
+	if err != nil {
+		d.err = err
+		return err
+	}
+
+	buf := d.frame
+	log.Debugf("Read frame, current ID: %d", d.cur_id)
+
+	data := func(b byte) {
+		switch {
+		case d.cur_id == TRIGGER_ID:
+			d.trigger(b)
+		case ReservedID(d.cur_id):
+			// Null padding or reserved, not trace
+		default:
+			d.counts[d.cur_id]++
+			emit(d.cur_id, b)
+		}
+	}
+
+	for i := uint(0); i < secondLastByte; i += 2 {
+		aux := buf[lastByteRecord] >> (i / 2) & 1
+		log.Debugf("buf[%0d]=%#v buf[%0d]=%#v buf[15]=%#v aux=%#v", i, buf[i], i+1, buf[i+1], buf[lastByteRecord], aux)
+		if d.frame_sync && bytes.Equal(buf[i:i+2], HSYNC) {
+			log.Debugf("Half-word sync at buf[%d]", i)
+		} else if buf[i]&1 == 0 { // Data mode
+			data((buf[i] & 0xfe) | aux)
+			data(buf[i+1])
+		} else if aux == 0 { // bit[0] set, new ID immediately
+			d.setID(buf[i])
+			data(buf[i+1])
+		} else { // Update with new ID after the following byte
+			data(buf[i+1])
+			d.setID(buf[i])
+		}
+	}
+	if buf[secondLastByte]&1 == 1 { // Update ID
+		d.setID(buf[secondLastByte])
+	} else {
+		data((buf[secondLastByte] & 0xfe) | (buf[lastByteRecord]>>7)&1)
+	}
+	return nil
+}
+
+// readFrame fills d.frame with the next formatter frame, skipping any frame
+// syncs before it.
+func (d *Demuxer) readFrame() error {
+	if !d.frame_sync {
+		d.frame_off = d.offset
+		_, err := d.read(d.frame)
+		return err
+	}
+
+	if !d.synced {
+		if err := d.findSync(); err != nil {
+			return err
+		}
+		d.synced = true
+	}
+
+	for {
+		d.skipSyncs()
+
+		d.frame_off = d.offset
+		n, err := d.read(d.frame)
+		if err != nil {
+			return err
+		}
+
+		// A frame sync inside the frame means the stream was misaligned,
+		// restart the frame at it
+		i := 4
+		for i < n && !bytes.Equal(d.frame[i:i+4], FSYNC) {
+			i += 4
+		}
+		if i == n {
+			return nil
+		}
+		if d.sync_lost != nil {
+			d.sync_lost(d.frame_off + int64(i))
+		}
+		d.unread(d.frame[i:n])
+	}
+}
+
+// findSync skips to the byte after the first full frame sync.
+func (d *Demuxer) findSync() error {
+	var last []byte
+	b := make([]byte, 1)
+	for !bytes.Equal(last, FSYNC) {
+		_, err := d.read(b)
+		if err == io.EOF {
+			return fmt.Errorf("no TPIU frame sync found in input")
+		}
+		if err != nil {
+			return err
+		}
+		last = append(last, b[0])
+		if len(last) > len(FSYNC) {
+			last = last[1:]
+		}
+	}
+	return nil
+}
+
+// skipSyncs discards any full frame syncs at the current position.
+func (d *Demuxer) skipSyncs() {
+	for bytes.Equal(d.peek(len(FSYNC)), FSYNC) {
+		d.read(make([]byte, len(FSYNC)))
+	}
+}
+
+// read fills p from any pushed back bytes and then the input, as
+// io.ReadFull does.
+func (d *Demuxer) read(p []byte) (int, error) {
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+
+	m, err := io.ReadFull(d.in, p[n:])
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	d.offset += int64(n + m)
+	return n + m, err
+}
+
+// peek returns up to the next n bytes without consuming them.
+func (d *Demuxer) peek(n int) []byte {
+	if len(d.pending) >= n {
+		return d.pending[:n]
+	}
+	next, _ := d.in.Peek(n - len(d.pending))
+	return append(append([]byte(nil), d.pending...), next...)
+}
+
+// unread pushes b back in front of the input, to be read again from the
+// offset it was first read at.
+func (d *Demuxer) unread(b []byte) {
+	d.pending = append(append([]byte(nil), b...), d.pending...)
+	d.offset -= int64(len(b))
+}
+
+func (d *Demuxer) trigger(value byte) {
+	positions := make(map[uint64]int64, len(d.counts))
+	for id, count := range d.counts {
+		positions[id] = count
+	}
+	log.Debugf("Trigger 0x%02x in frame at 0x%x", value, d.frame_off)
+	d.triggers = append(d.triggers, Trigger{offset: d.frame_off, value: value, positions: positions})
+}
+
+// Triggers returns the trigger markers decoded since the last call.  Frames
+// are decoded ahead of the trace read from a Stream, so use Position to place
+// each one in the Stream.
+func (d *Demuxer) Triggers() []Trigger {
+	triggers := d.triggers
+	d.triggers = nil
+	return triggers
+}
+
+// ReservedID reports whether id is the null ID or one the formatter reserves,
+// none of which carry trace.  The trigger ID is reserved too.
+func ReservedID(id uint64) bool {
+	return id == NULL_ID || id >= 0x70
+}
+
+func (d *Demuxer) setID(b byte) {
+	id := uint64((b >> 1) & 0x7f)
+	log.Debugf("ID update %d -> %d", d.cur_id, id)
+	d.cur_id = id
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		err := s.demux.nextFrame(func(id uint64, b byte) {
+			if stream := s.demux.streams[id]; stream != nil {
+				stream.buf = append(stream.buf, b)
+				stream.total++
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// ID returns the trace ID the Stream carries.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Total returns the number of bytes demultiplexed into the Stream so far.
+func (s *Stream) Total() int64 {
+	return s.total
+}
+
+// Offset returns the input offset of the frame holding the trigger.
+func (t Trigger) Offset() int64 {
+	return t.offset
+}
+
+// Value returns the data byte sent with the trigger ID.
+func (t Trigger) Value() byte {
+	return t.value
+}
+
+// Position returns how many bytes of the trace of id preceded the trigger.
+func (t Trigger) Position(id uint64) int64 {
+	return t.positions[id]
+}
+
+func (t Trigger) String() string {
+	return fmt.Sprintf("Trigger: 0x%02x (input offset 0x%x)", t.value, t.offset)
+}
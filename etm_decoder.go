@@ -1,14 +1,22 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
+	armtrace "github.com/nickjones/etm/armtrace"
 	etf "github.com/nickjones/etm/etf"
+	etmv3 "github.com/nickjones/etm/etmv3"
+	itm "github.com/nickjones/etm/itm"
+	ptm "github.com/nickjones/etm/ptm"
+	stm "github.com/nickjones/etm/stm"
+	topology "github.com/nickjones/etm/topology"
 	pkts "github.com/nickjones/etm/tracepkts"
 )
 
@@ -21,179 +29,460 @@ var BUILD_DATE string
 var (
 	debug         = flag.Bool("debug", false, "Debug logging.")
 	etfMode       = flag.Bool("etf", false, "Input file is a binary ETF trace dump.")
-	noEtfSync     = flag.Bool("noetfsync", true, "Input ETF binary lacks a frame sync.")
-	etfEtmID      = flag.Int("id", 0, "Trace ID for ETM traffic to parse in ETF mode.")
+	noEtfSync     = flag.Bool("noetfsync", true, "Input ETF binary lacks a frame sync, set false for TPIU port captures.")
+	etfEtmID      = flag.Int("id", 0, "Trace ID for ETM traffic to parse in ETF mode, 0x01-0x6f.  Required with -etf unless -topology or -sysfs is given.")
 	dbgDisIDCheck = flag.Bool("disidchk", false, "Disable ETF trace ID checks.")
-	keepTmp       = flag.Bool("keeptmpbin", false, "Keep temporary ETF->ETM file.")
+	dataMode      = flag.Bool("data", false, "Input is an ETMv4 data trace stream.")
+	protocol      = flag.String("protocol", "etmv4", "Trace protocol of the input: etmv4, ete, ptm, etmv3, stm or itm.")
+	rawMode       = flag.Bool("raw", false, "Prefix each packet with its stream offset and raw bytes.")
+	resync        = flag.Bool("resync", false, "Skip to the next Async after a decode error, reporting the gap.")
+	configFile    = flag.String("config", "", "ETM ID and config register dump (JSON or name=value lines) describing the trace unit.")
+	sysfsDir      = flag.String("sysfs", "", "Copy of the CoreSight sysfs tree to take the ETM configuration from, picked by -id.")
+	topologyFile  = flag.String("topology", "", "Topology file (JSON or YAML) naming the trace sources of an ETF dump, all of which are decoded.")
+	showContext   = flag.Bool("context", false, "Follow each ETMv4 address with the EL, security state and IDs in effect.")
 )
 
-type ETMv4AddressStackElement struct {
-	address uint64
-	is      uint8
-}
-
-type ETMv4AddressStack struct {
-	entries []ETMv4AddressStackElement
-}
-
 func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s version %s\n", os.Args[0], VERSION)
 		fmt.Fprintf(os.Stderr, "build %s\n", BUILD_DATE)
-		fmt.Fprintln(os.Stderr, "usage:")
+		fmt.Fprintln(os.Stderr, "usage: [flags] [file], - or no file reads stdin")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
 	args := flag.Args()
 
-	if len(args) == 0 {
-		log.Fatal("Not enough arguments, need a /path/to/file")
+	// No file or "-" reads from stdin, so captures can be piped in
+	filename := "-"
+	if len(args) > 0 {
+		filename = args[0]
 	}
 
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	filename := args[0]
+	// Both describe the trace unit, neither can sensibly override the other
+	if *configFile != "" && *sysfsDir != "" {
+		log.Fatal("-config and -sysfs both give the ETM configuration, use only one")
+	}
 
 	fmt.Println("Filename:", filename)
 
-	var err error
+	file := os.Stdin
+	if filename != "-" {
+		var err error
+		file, err = os.Open(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+	}
 
-	file, err := os.Open(filename)
-	defer file.Close()
+	// Every source of the ETF dump is decoded when there's a topology
+	var topo *topology.Topology
+	if *topologyFile != "" {
+		var err error
+		topo, err = topology.Load(*topologyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *sysfsDir != "" {
+			topo.SetConfig(sysfsConfigs(*sysfsDir))
+		}
+	} else if *etfMode && *sysfsDir != "" && *etfEtmID == 0 {
+		sources, err := pkts.LoadSysfs(*sysfsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		topo = topology.FromSysfs(sources)
+	}
 
+	if topo != nil {
+		decodeTopology(file, topo)
+		return
+	}
+
+	opts, isSTM, err := protocolOptions(*protocol)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *configFile != "" {
+		opts.Config, err = pkts.LoadConfigFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *sysfsDir != "" {
+		opts.Config = sysfsConfig(*sysfsDir)
+	}
+
+	var in io.Reader = file
+	var demux *etf.Demuxer
+	var etfStream *etf.Stream
 
 	if *etfMode {
 		log.Println("Parsing input as ETF trace storage format.")
-		// Input file needs to be parsed into raw ETM trace first
-		traceFiles, err := etf.NewDecoder(file)
-
-		// Open the temp file of interest to the user
-		traceID := uint64(*etfEtmID)
-		if len(traceFiles[traceID]) > 0 {
-			file, err = os.Open(traceFiles[traceID])
-			if err != nil {
-				log.Errorf("Error opening temp file from ETF parsing: %q", err)
-			}
-		} else {
-			log.Errorf("Unable to find ETF trace ID %d", *etfEtmID)
+		if *etfEtmID == 0 {
+			log.Fatal("-etf needs the -id of the trace to decode, or -topology or -sysfs to decode every source")
+		}
+		if etf.ReservedID(uint64(*etfEtmID)) {
+			log.Fatalf("ETF trace ID 0x%x is reserved by the formatter and carries no trace", *etfEtmID)
 		}
 
-		defer file.Close()
-		// ETF parsing creates temp files for each ID, remove them all (eventually)
-		if !*keepTmp {
-			defer func() {
-				for i := range traceFiles {
-					os.Remove(traceFiles[i])
-				}
-			}()
+		// Pull the ETM trace of interest out of the formatter frames as it's read
+		demux = newDemuxer(file)
+		etfStream = demux.Stream(uint64(*etfEtmID))
+		in = etfStream
+	}
+
+	var before func(offset int64, eof bool, timestamp uint64, ts_valid bool)
+	if demux != nil {
+		// Print triggers ahead of the first packet following them
+		triggers := &triggerQueue{id: etfStream.ID()}
+		before = func(offset int64, eof bool, timestamp uint64, ts_valid bool) {
+			triggers.add(demux.Triggers())
+			triggers.before(offset, eof, timestamp, ts_valid)
 		}
 	}
 
-	log.Debugln("Synchronizing trace stream.  Looking for Async")
-	// Sync trace stream; search for consecutive bytes of 00 (at least 11) followed by 80
-	asyncByteCnt := 0
-	for {
-		b := make([]byte, 1)
-		_, err := file.Read(b)
+	if isSTM {
+		decodeSTM(in, "", before)
+	} else {
+		decodeStream(in, opts, "", before)
+	}
+
+	if etfStream != nil && etfStream.Total() == 0 {
+		log.Errorf("Unable to find ETF trace ID %d", *etfEtmID)
+	}
+}
 
+// protocolOptions returns the Decoder options for a -protocol name, or true
+// for STM which has a decoder of its own.
+func protocolOptions(protocol string) (pkts.Options, bool, error) {
+	var opts pkts.Options
+
+	switch strings.ToLower(protocol) {
+	case "stm":
+		// STP is nibble oriented, decoded separately
+		return opts, true, nil
+	case "ptm":
+		opts.PacketFunc = ptm.DecodePacket
+		opts.AsyncZeros = armtrace.ASYNC_ZEROS
+	case "etmv3":
+		opts.PacketFunc = etmv3.DecodePacket
+		opts.AsyncZeros = armtrace.ASYNC_ZEROS
+	case "itm":
+		// SWO captures need not contain a sync packet, decode from the start
+		opts.PacketFunc = itm.DecodePacket
+		opts.AsyncZeros = itm.ASYNC_ZEROS
+		opts.NoSync = true
+	default:
+		proto, err := pkts.ParseProtocol(protocol)
 		if err != nil {
-			log.Fatal(err)
+			return opts, false, err
 		}
+		opts.Protocol = proto
+		opts.Data = *dataMode
+	}
+
+	opts.Resync = *resync
+	return opts, false, nil
+}
+
+func newDemuxer(in io.Reader) *etf.Demuxer {
+	if *noEtfSync {
+		return etf.NewDemuxer(in)
+	}
+	// TPIU port captures start anywhere and carry frame syncs
+	demux := etf.NewTPIUDemuxer(in)
+	demux.OnSyncLost(func(offset int64) {
+		log.Printf("WARN: ETF frame sync lost, realigning at input offset 0x%x", offset)
+	})
+	return demux
+}
 
-		if *debug {
-			log.Printf("Current byte: %x\n", b)
+// decodeTopology decodes every source of the topology found in an ETF dump,
+// each with its own decoder, labelling the output with the source names.
+func decodeTopology(in io.Reader, topo *topology.Topology) {
+	log.Println("Parsing input as ETF trace storage format.")
+	demux := newDemuxer(in)
+
+	var wg sync.WaitGroup
+	pipes := make(map[uint64]*io.PipeWriter)
+	queues := make(map[uint64]*triggerQueue)
+
+	for _, source := range topo.Sources() {
+		log.Debugln(source.String())
+
+		opts, isSTM, err := protocolOptions(source.Protocol())
+		if err != nil {
+			log.Fatal(err)
 		}
-		if asyncByteCnt < 11 && b[0] == 0x00 {
-			asyncByteCnt++
-		} else if asyncByteCnt == 11 && b[0] == 0x80 {
-			// Trace unit synchronized
-			break
-		} else {
-			asyncByteCnt = 0
+		opts.Config = source.Config()
+
+		reader, writer := io.Pipe()
+		pipes[source.TraceID()] = writer
+		triggers := &triggerQueue{id: source.TraceID(), label: source.Name()}
+		queues[source.TraceID()] = triggers
+
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			if isSTM {
+				decodeSTM(reader, label, triggers.before)
+			} else {
+				decodeStream(reader, opts, label, triggers.before)
+			}
+			// Don't stall the other sources if this one stopped early
+			io.Copy(ioutil.Discard, reader)
+		}(source.Name())
+	}
+
+	// Every source sees each trigger, queued before any data following it
+	queueTriggers := func() {
+		triggers := demux.Triggers()
+		for _, queue := range queues {
+			queue.add(triggers)
 		}
 	}
-	traceStartPos, err := file.Seek(0, os.SEEK_CUR)
-	if *debug {
-		log.Println("Trace unit synchronized at fpos ", traceStartPos)
+	err := demux.Each(func(id uint64, data []byte) {
+		queueTriggers()
+		if writer := pipes[id]; writer != nil {
+			writer.Write(data)
+		}
+	})
+	queueTriggers()
+	for _, writer := range pipes {
+		writer.CloseWithError(err)
 	}
+	wg.Wait()
 
-	// Seek backwards to the beginning of ASYNC
-	_, err = file.Seek(traceStartPos-12, os.SEEK_SET)
 	if err != nil {
 		log.Fatal(err)
 	}
-	input := bufio.NewReader(file)
+	for _, id := range demux.IDs() {
+		if _, ok := topo.Source(id); !ok {
+			log.Printf("WARN: ETF trace ID 0x%x isn't in the topology, skipped", id)
+		}
+	}
+}
+
+// triggerQueue holds the ETF triggers still to be printed in the trace of one
+// source.  The demuxer adds to it while the source's decoder takes from it.
+type triggerQueue struct {
+	lock     sync.Mutex
+	id       uint64
+	label    string
+	triggers []etf.Trigger
+}
+
+func (q *triggerQueue) add(triggers []etf.Trigger) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.triggers = append(q.triggers, triggers...)
+}
+
+// before prints the triggers at or ahead of offset in the source's trace, or
+// all that are left at the end of it, with the timestamp in effect there.
+func (q *triggerQueue) before(offset int64, eof bool, timestamp uint64, ts_valid bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.triggers) > 0 && (eof || q.triggers[0].Position(q.id) <= offset) {
+		line := q.triggers[0].String()
+		if ts_valid {
+			line += fmt.Sprintf(" TS: 0x%x", timestamp)
+		}
+		printLine(q.label, line)
+		q.triggers = q.triggers[1:]
+	}
+}
 
-	var addr_stack ETMv4AddressStack
+// decodeStream prints every packet of a single trace source.  before is
+// called with the offset of each packet and the timestamp preceding it ahead
+// of printing it, and once more at the end of the stream.
+func decodeStream(in io.Reader, opts pkts.Options, label string, before func(offset int64, eof bool, timestamp uint64, ts_valid bool)) {
+	decoder := pkts.NewDecoder(in, opts)
+	addr_stack := decoder.AddressStack()
+	var arm_state armtrace.AddressState
+	profile := itm.NewProfile()
 
 	for {
-		header, err := input.ReadByte()
+		// Triggers ahead of the packet fall under the timestamp before it
+		timestamp, ts_valid := decoder.Timestamp()
+		pkt, err := decoder.Next()
+		if before != nil {
+			before(decoder.PacketOffset(), err == io.EOF, timestamp, ts_valid)
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			if !pkts.IsPacketError(err) {
+				log.Fatal(err)
+			}
+			log.Printf("WARN: %s%v\n", labelPrefix(label), err)
+			continue
 		}
-		log.Debugf("Pre DecodePacket header=0x%02x\n", header)
-		pkt := pkts.DecodePacket(header, input)
-		if pkt != nil {
-			switch pkt.(type) {
-			default:
-				fmt.Println(pkt.String())
-
-			case pkts.Long64bAddrETMv4:
-				addr_pkt := pkt.(pkts.Long64bAddrETMv4)
-				addr_stack.Push(addr_pkt.Address(), addr_pkt.IS())
-				fmt.Println(pkt.String())
-
-			case pkts.CompressedAddrETMv4:
-				addr_pkt := pkt.(pkts.CompressedAddrETMv4)
-				addr_base_elm := addr_stack.Get(0)
-				addr := addr_pkt.AddrWithBase(addr_base_elm.address)
-				addr_stack.Push(addr, addr_pkt.IS())
-				fmt.Printf("IS%d Address = 0x%016x (Compressed %d-bit)\n", addr_pkt.IS(), addr, addr_pkt.Width())
-
-			case pkts.ExactAddrETMv4:
-				exact_pkt := pkt.(pkts.ExactAddrETMv4)
-				entry_num := exact_pkt.Entry()
-				stack_elm := addr_stack.Get(entry_num)
-				addr_stack.Push(stack_elm.address, stack_elm.is)
-				fmt.Printf("IS%d Address = 0x%016x (Exact Match)\n", stack_elm.is, stack_elm.address)
+		profile.Add(pkt)
+
+		var line string
+		switch pkt.(type) {
+		default:
+			line = pkt.String()
+
+		case pkts.Long64bAddrETMv4, pkts.CompressedAddrETMv4, pkts.ExactAddrETMv4:
+			line = addressString(pkt, addr_stack.Get(0))
+			if *showContext {
+				line += " " + decoder.Context().String()
+			}
+
+		case pkts.DataAddrETMv4, pkts.DataExactAddrETMv4:
+			line = addressString(pkt, decoder.DataAddressStack().Get(0))
 
+		case pkts.ContextETMv4:
+			ctxt_pkt := pkt.(pkts.ContextETMv4)
+			if ctxt_pkt.PayloadValid() {
+				line = pkt.String()
+			} else {
+				line = fmt.Sprintf("Context (no payload): %s", decoder.Context().String())
 			}
-		} else {
-			log.Printf("WARN: Dropped byte 0x%x\n", header)
+
+		case pkts.QETMv4:
+			q_pkt := pkt.(pkts.QETMv4)
+			if q_pkt.Address() == nil {
+				line = pkt.String()
+			} else {
+				line = fmt.Sprintf("Q: Count: %d %s", q_pkt.Count(), addressString(q_pkt.Address(), addr_stack.Get(0)))
+			}
+
+		case pkts.SourceAddrETE:
+			src_pkt := pkt.(pkts.SourceAddrETE)
+			line = fmt.Sprintf("Source %s", addressString(src_pkt.Address(), addr_stack.Get(0)))
+
+		case ptm.ISyncPTM, ptm.BranchAddrPTM, ptm.WaypointPTM, etmv3.ISyncETMv3, etmv3.BranchAddrETMv3:
+			line = arm_state.Update(pkt)
+
+		}
+
+		if *rawMode {
+			line = rawLine(pkt, decoder, line)
 		}
+		printLine(label, line)
+	}
+
+	if profile.Total > 0 {
+		printLine(label, profile.String())
 	}
 }
 
-func (s *ETMv4AddressStack) Push(address uint64, is uint8) {
-	log.Debugf("Pushing addr=0x%016x is=%d\n", address, is)
-	s.entries = append([]ETMv4AddressStackElement{{address, is}}, s.entries...)
-	for i, e := range s.entries {
-		log.Debugf("Addr Stack %d: %#v\n", i, e)
+// Sources are decoded concurrently in topology mode, keep their lines whole
+var outputLock sync.Mutex
+
+// printLine prints a line of output, prefixed with the source it came from
+// when there's more than one.
+func printLine(label string, line string) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	fmt.Println(labelPrefix(label) + line)
+}
+
+func labelPrefix(label string) string {
+	if label == "" {
+		return ""
 	}
-	s.Compact()
+	return "[" + label + "] "
 }
 
-func (s *ETMv4AddressStack) Compact() {
-	// Drop oldest address, trace analyzer is required to keep a certain depth
-	if len(s.entries) > pkts.ADDR_COMP_STK_DEPTH {
-		s.entries = s.entries[:len(s.entries)-1]
+// rawLine prefixes a decoded packet with its stream offset and raw bytes for
+// cross-checking against a hexdump of the input.
+func rawLine(pkt pkts.TracePacket, decoder *pkts.Decoder, line string) string {
+	offset, raw := decoder.PacketOffset(), decoder.PacketBytes()
+	if raw_pkt, ok := pkt.(pkts.RawPacket); ok && raw_pkt.Raw() != nil {
+		offset, raw = raw_pkt.Offset(), raw_pkt.Raw()
 	}
+	return fmt.Sprintf("%08x: % x | %s", offset, raw, line)
 }
 
-func (s ETMv4AddressStack) Get(idx uint8) ETMv4AddressStackElement {
-	if len(s.entries) <= int(idx) {
-		log.Printf("WARN: Address stack match with missing entry!")
-		return ETMv4AddressStackElement{}
+// sysfsConfig returns the configuration of the ETM in a sysfs snapshot with
+// the -id trace ID, or the only ETM when -id wasn't given.
+func sysfsConfig(dir string) *pkts.Config {
+	sources, err := pkts.LoadSysfs(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, source := range sources {
+		log.Debugln(source.String())
+		if *etfEtmID == 0 && len(sources) == 1 || source.TraceID() == uint64(*etfEtmID) {
+			log.Printf("Using configuration of %s", source.String())
+			return source.Config()
+		}
+	}
+	log.Fatalf("No ETM with trace ID 0x%x in %s", *etfEtmID, dir)
+	return nil
+}
+
+// sysfsConfigs returns the configuration of every ETM in a sysfs snapshot by
+// trace ID.
+func sysfsConfigs(dir string) map[uint64]*pkts.Config {
+	sources, err := pkts.LoadSysfs(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	configs := make(map[uint64]*pkts.Config)
+	for _, source := range sources {
+		configs[source.TraceID()] = source.Config()
+	}
+	return configs
+}
+
+// decodeSTM prints every packet of a System Trace Protocol stream, calling
+// before as decodeStream does.
+func decodeSTM(in io.Reader, label string, before func(offset int64, eof bool, timestamp uint64, ts_valid bool)) {
+	decoder := stm.NewDecoder(in)
+
+	for {
+		// Triggers ahead of the packet fall under the timestamp before it
+		timestamp, ts_valid := decoder.Timestamp()
+		pkt, err := decoder.Next()
+		if before != nil {
+			before(decoder.PacketOffset(), err == io.EOF, timestamp, ts_valid)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !pkts.IsPacketError(err) {
+				log.Fatal(err)
+			}
+			log.Printf("WARN: %s%v\n", labelPrefix(label), err)
+			continue
+		}
+		printLine(label, pkt.String())
+	}
+}
+
+// addressString describes an ETMv4 address packet once the address stack has
+// resolved it to elm.
+func addressString(pkt pkts.TracePacket, elm pkts.ETMv4AddressStackElement) string {
+	switch pkt.(type) {
+	case pkts.CompressedAddrETMv4:
+		addr_pkt := pkt.(pkts.CompressedAddrETMv4)
+		return fmt.Sprintf("IS%d Address = 0x%016x (Compressed %d-bit)", elm.IS(), elm.Address(), addr_pkt.Width())
+
+	case pkts.ExactAddrETMv4:
+		return fmt.Sprintf("IS%d Address = 0x%016x (Exact Match)", elm.IS(), elm.Address())
+
+	case pkts.DataAddrETMv4:
+		addr_pkt := pkt.(pkts.DataAddrETMv4)
+		return fmt.Sprintf("Data Address = 0x%016x (%d-bit)", elm.Address(), addr_pkt.Width())
+
+	case pkts.DataExactAddrETMv4:
+		return fmt.Sprintf("Data Address = 0x%016x (Exact Match)", elm.Address())
 	}
-	return s.entries[idx]
+	return pkt.String()
 }
@@ -0,0 +1,96 @@
+package etmv3
+
+import (
+	"fmt"
+	"strings"
+
+	armtrace "github.com/nickjones/etm/armtrace"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type PHeaderETMv3 struct {
+	*GenericTracePacketv3
+	format int
+	taken  []bool
+}
+
+type BranchAddrETMv3 struct {
+	*GenericTracePacketv3
+	armtrace.BranchAddr
+}
+
+type ExceptionEntryETMv3 struct {
+	*GenericTracePacketv3
+}
+
+type ExceptionExitETMv3 struct {
+	*GenericTracePacketv3
+}
+
+// DecodePHeader decodes the non cycle-accurate P-header formats.  Format 1
+// (0b1NEEEE00) is EEEE E atoms followed by N N atoms, format 2 (0b1000FF10)
+// is two atoms where a set F bit is an N atom.
+func DecodePHeader(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	switch {
+	case header&0x3 == 0x0:
+		pkt := PHeaderETMv3{format: 1}
+		for i := 0; i < int(header>>2)&0xf; i++ {
+			pkt.taken = append(pkt.taken, pkts.ATOM_E)
+		}
+		if header&0x40 == 0x40 {
+			pkt.taken = append(pkt.taken, pkts.ATOM_N)
+		}
+		return pkt, nil
+	case header&0xf3 == 0x82:
+		return PHeaderETMv3{format: 2, taken: []bool{header&0x8 == 0, header&0x4 == 0}}, nil
+	}
+	return nil, reserved(reader, header)
+}
+
+func DecodeBranchAddr(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	addr, err := armtrace.DecodeBranchAddr(header, reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Branch Address", err)
+	}
+	return BranchAddrETMv3{BranchAddr: addr}, nil
+}
+
+func DecodeExceptionEntry(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return ExceptionEntryETMv3{}, nil
+}
+
+func DecodeExceptionExit(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return ExceptionExitETMv3{}, nil
+}
+
+func (pkt PHeaderETMv3) Atoms() []bool {
+	return pkt.taken
+}
+
+func (pkt PHeaderETMv3) String() string {
+	var sb strings.Builder
+	for _, br := range pkt.taken {
+		if br {
+			sb.WriteString("T ")
+		} else {
+			sb.WriteString("NT ")
+		}
+	}
+	return fmt.Sprintf("Branch(es): %s(P-header Format %d)", sb.String(), pkt.format)
+}
+
+func (pkt BranchAddrETMv3) String() string {
+	field, bits := pkt.Bits()
+	if excp, ok := pkt.Exception(); ok {
+		return fmt.Sprintf("Branch Address: Offset = 0x%x (%d-bit) Exception: %d NS: %t Cancel: %t", field, bits, excp, pkt.NS(), pkt.Cancel())
+	}
+	return fmt.Sprintf("Branch Address: Offset = 0x%x (%d-bit)", field, bits)
+}
+
+func (ExceptionEntryETMv3) String() string {
+	return "Exception Entry"
+}
+
+func (ExceptionExitETMv3) String() string {
+	return "Exception Exit"
+}
@@ -0,0 +1,213 @@
+package etmv3
+
+import (
+	"bytes"
+	"fmt"
+
+	armtrace "github.com/nickjones/etm/armtrace"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type AsyncETMv3 struct {
+	*GenericTracePacketv3
+}
+
+type ISyncETMv3 struct {
+	*GenericTracePacketv3
+	armtrace.ISync
+
+	cycle_count_valid bool
+	cycle_count       uint32
+}
+
+type TriggerETMv3 struct {
+	*GenericTracePacketv3
+}
+
+type ContextIDETMv3 struct {
+	*GenericTracePacketv3
+	cid uint32
+}
+
+type VMIDETMv3 struct {
+	*GenericTracePacketv3
+	vmid uint8
+}
+
+type TimestampETMv3 struct {
+	*GenericTracePacketv3
+	timestamp         uint64
+	cycle_count_valid bool
+	cycle_count       uint32
+}
+
+type IgnoreETMv3 struct {
+	*GenericTracePacketv3
+}
+
+type CycleCountETMv3 struct {
+	*GenericTracePacketv3
+	cycle_count uint32
+}
+
+func DecodeAsync(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	if err := armtrace.ReadAsync(header, reader); err != nil {
+		return nil, err
+	}
+	return AsyncETMv3{}, nil
+}
+
+func DecodeISync(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := ISyncETMv3{}
+
+	// I-sync with cycle count leads with the count
+	if header == 0x70 {
+		count, err := armtrace.ReadCycleCount(reader)
+		if err != nil {
+			return nil, truncated(reader, header, "I-sync", err)
+		}
+		pkt.cycle_count_valid = true
+		pkt.cycle_count = count
+	}
+
+	if err := pkt.ReadContextID(reader); err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+
+	info, err := pkt.ReadInfo(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+
+	// The J bit makes bit[0] of the address part of a Jazelle address
+	if err := pkt.ReadAddress(reader, info&0x10 == 0x10); err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+	return pkt, nil
+}
+
+func DecodeCycleCount(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	count, err := armtrace.ReadCycleCount(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Cycle Count", err)
+	}
+	return CycleCountETMv3{cycle_count: count}, nil
+}
+
+func DecodeTrigger(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return TriggerETMv3{}, nil
+}
+
+func DecodeContextID(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	cid, err := armtrace.ReadContextID(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Context ID", err)
+	}
+	return ContextIDETMv3{cid: cid}, nil
+}
+
+func DecodeVMID(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	vmid, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "VMID", err)
+	}
+	return VMIDETMv3{vmid: uint8(vmid)}, nil
+}
+
+func DecodeTimestamp(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := TimestampETMv3{}
+
+	if header&0x4 == 0x4 {
+		pkt.cycle_count_valid = true
+	}
+
+	timestamp, err := armtrace.ReadTimestamp(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Timestamp", err)
+	}
+	pkt.timestamp = timestamp
+
+	if pkt.cycle_count_valid {
+		count, err := armtrace.ReadCycleCount(reader)
+		if err != nil {
+			return nil, truncated(reader, header, "Timestamp", err)
+		}
+		pkt.cycle_count = count
+	}
+	return pkt, nil
+}
+
+func DecodeIgnore(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return IgnoreETMv3{}, nil
+}
+
+func (AsyncETMv3) String() string {
+	return "A-sync"
+}
+
+// CycleCount returns the cycle count of an I-sync with cycle count packet.
+func (pkt ISyncETMv3) CycleCount() (uint32, bool) {
+	return pkt.cycle_count, pkt.cycle_count_valid
+}
+
+func (pkt ISyncETMv3) String() string {
+	if pkt.cycle_count_valid {
+		return fmt.Sprintf("%s Cycle Count: 0x%x", pkt.ISync.String(), pkt.cycle_count)
+	}
+	return pkt.ISync.String()
+}
+
+func (TriggerETMv3) String() string {
+	return "Trigger"
+}
+
+func (pkt ContextIDETMv3) ContextID() uint32 {
+	return pkt.cid
+}
+
+func (pkt ContextIDETMv3) String() string {
+	return fmt.Sprintf("Context ID: %x", pkt.cid)
+}
+
+func (pkt VMIDETMv3) VMID() uint8 {
+	return pkt.vmid
+}
+
+func (pkt VMIDETMv3) String() string {
+	return fmt.Sprintf("VMID: %x", pkt.vmid)
+}
+
+func (pkt TimestampETMv3) Timestamp() uint64 {
+	return pkt.timestamp
+}
+
+func (pkt TimestampETMv3) CycleCountValid() bool {
+	return pkt.cycle_count_valid
+}
+
+func (pkt TimestampETMv3) CycleCount() uint32 {
+	return pkt.cycle_count
+}
+
+func (pkt TimestampETMv3) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Timestamp: 0x%x", pkt.timestamp))
+
+	if pkt.cycle_count_valid {
+		buffer.WriteString(fmt.Sprintf(" Cycle Count: 0x%x", pkt.cycle_count))
+	}
+	return buffer.String()
+}
+
+func (IgnoreETMv3) String() string {
+	return "Ignore"
+}
+
+func (pkt CycleCountETMv3) CycleCount() uint32 {
+	return pkt.cycle_count
+}
+
+func (pkt CycleCountETMv3) String() string {
+	return fmt.Sprintf("Cycle Count: %d", pkt.cycle_count)
+}
@@ -0,0 +1,49 @@
+package etmv3
+
+import (
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type GenericTracePacketv3 struct {
+	// header byte
+}
+
+// DecodePacket decodes a single packet from an ETMv3 instruction trace
+// stream.  Data trace packets are not supported.
+func DecodePacket(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	switch {
+	case header == 0x00:
+		return DecodeAsync(header, reader)
+	case header == 0x04:
+		return DecodeCycleCount(header, reader)
+	case header == 0x08 || header == 0x70:
+		return DecodeISync(header, reader)
+	case header == 0x0c:
+		return DecodeTrigger(header, reader)
+	case header == 0x3c:
+		return DecodeVMID(header, reader)
+	case header == 0x42 || header == 0x46:
+		return DecodeTimestamp(header, reader)
+	case header == 0x66:
+		return DecodeIgnore(header, reader)
+	case header == 0x6e:
+		return DecodeContextID(header, reader)
+	case header == 0x76:
+		return DecodeExceptionExit(header, reader)
+	case header == 0x7e:
+		return DecodeExceptionEntry(header, reader)
+	case header&0x1 == 0x1:
+		return DecodeBranchAddr(header, reader)
+	case header&0x81 == 0x80:
+		return DecodePHeader(header, reader)
+	}
+	return nil, reserved(reader, header)
+}
+
+func truncated(reader *pkts.Reader, header byte, packet string, err error) error {
+	return &pkts.TruncatedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: packet, Err: err}
+}
+
+func reserved(reader *pkts.Reader, header byte) error {
+	return &pkts.ReservedHeaderError{Offset: reader.PacketOffset(), Header: header}
+}
@@ -0,0 +1,60 @@
+package itm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Profile accumulates DWT PC samples into a histogram.
+type Profile struct {
+	Samples map[uint32]uint64
+	Sleep   uint64
+	Total   uint64
+}
+
+func NewProfile() *Profile {
+	return &Profile{Samples: make(map[uint32]uint64)}
+}
+
+// Add records pkt if it is a PC sample, other packets are ignored.
+func (p *Profile) Add(pkt pkts.TracePacket) {
+	sample, ok := pkt.(PCSampleDWT)
+	if !ok {
+		return
+	}
+
+	p.Total++
+	if sample.Sleep() {
+		p.Sleep++
+	} else {
+		p.Samples[sample.PC()]++
+	}
+}
+
+// String lists sampled PCs from most to least frequent.
+func (p *Profile) String() string {
+	var buffer bytes.Buffer
+
+	pcs := make([]uint32, 0, len(p.Samples))
+	for pc := range p.Samples {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if p.Samples[pcs[i]] == p.Samples[pcs[j]] {
+			return pcs[i] < pcs[j]
+		}
+		return p.Samples[pcs[i]] > p.Samples[pcs[j]]
+	})
+
+	buffer.WriteString(fmt.Sprintf("PC Sample Profile: %d samples", p.Total))
+	for _, pc := range pcs {
+		buffer.WriteString(fmt.Sprintf("\n0x%08x %d (%.2f%%)", pc, p.Samples[pc], 100*float64(p.Samples[pc])/float64(p.Total)))
+	}
+	if p.Sleep > 0 {
+		buffer.WriteString(fmt.Sprintf("\nSleep      %d (%.2f%%)", p.Sleep, 100*float64(p.Sleep)/float64(p.Total)))
+	}
+	return buffer.String()
+}
@@ -0,0 +1,211 @@
+package itm
+
+import (
+	"fmt"
+
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Hardware source packet discriminator IDs
+const (
+	DWT_EVENT_COUNTER = 0
+	DWT_EXCEPTION     = 1
+	DWT_PC_SAMPLE     = 2
+)
+
+// Exception trace function field
+const (
+	EXCP_ENTERED  = 1
+	EXCP_EXITED   = 2
+	EXCP_RETURNED = 3
+)
+
+// Event counter wrap bits
+const (
+	EVENT_CPI = 1 << iota
+	EVENT_EXC
+	EVENT_SLEEP
+	EVENT_LSU
+	EVENT_FOLD
+	EVENT_CYC
+)
+
+type InstrumentationITM struct {
+	*GenericTracePacketITM
+	port    uint8
+	size    uint8
+	payload uint32
+}
+
+type EventCounterDWT struct {
+	*GenericTracePacketITM
+	events uint8
+}
+
+type ExceptionDWT struct {
+	*GenericTracePacketITM
+	number   uint16
+	function uint8
+}
+
+type PCSampleDWT struct {
+	*GenericTracePacketITM
+	sleep bool
+	pc    uint32
+}
+
+type DataTraceDWT struct {
+	*GenericTracePacketITM
+	id         uint8
+	comparator uint8
+	size       uint8
+	payload    uint32
+}
+
+var excpFunctions = [...]string{
+	"Reserved",
+	"Entered",
+	"Exited",
+	"Returned",
+}
+
+func DecodeInstrumentation(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := InstrumentationITM{port: uint8(header >> 3)}
+
+	var err error
+	pkt.payload, pkt.size, err = readPayload(header, reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Instrumentation", err)
+	}
+	return pkt, nil
+}
+
+func DecodeHardwareSource(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	id := uint8(header >> 3)
+
+	payload, size, err := readPayload(header, reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Hardware Source", err)
+	}
+
+	switch {
+	case id == DWT_EVENT_COUNTER:
+		return EventCounterDWT{events: uint8(payload)}, nil
+	case id == DWT_EXCEPTION:
+		return ExceptionDWT{number: uint16(payload & 0x1ff), function: uint8(payload>>12) & 0x3}, nil
+	case id == DWT_PC_SAMPLE:
+		// A single byte payload is a sleep sample
+		if size == 1 {
+			return PCSampleDWT{sleep: true}, nil
+		}
+		return PCSampleDWT{pc: payload}, nil
+	case id >= 8 && id <= 23:
+		return DataTraceDWT{id: id, comparator: (id >> 1) & 0x3, size: size, payload: payload}, nil
+	}
+	return nil, reserved(reader, header)
+}
+
+// Port returns the stimulus port within the current page.
+func (pkt InstrumentationITM) Port() uint8 {
+	return pkt.port
+}
+
+// Size returns the payload size in bytes.
+func (pkt InstrumentationITM) Size() uint8 {
+	return pkt.size
+}
+
+func (pkt InstrumentationITM) Payload() uint32 {
+	return pkt.payload
+}
+
+func (pkt InstrumentationITM) String() string {
+	return fmt.Sprintf("Stimulus Port %d: 0x%0*x", pkt.port, 2*pkt.size, pkt.payload)
+}
+
+// Events returns the counters that wrapped as EVENT_* bits.
+func (pkt EventCounterDWT) Events() uint8 {
+	return pkt.events
+}
+
+func (pkt EventCounterDWT) String() string {
+	return fmt.Sprintf("Event Counter: CPI: %t Exc: %t Sleep: %t LSU: %t Fold: %t Cyc: %t",
+		pkt.events&EVENT_CPI != 0, pkt.events&EVENT_EXC != 0, pkt.events&EVENT_SLEEP != 0,
+		pkt.events&EVENT_LSU != 0, pkt.events&EVENT_FOLD != 0, pkt.events&EVENT_CYC != 0)
+}
+
+func (pkt ExceptionDWT) Number() uint16 {
+	return pkt.number
+}
+
+// Function returns one of EXCP_ENTERED, EXCP_EXITED or EXCP_RETURNED.
+func (pkt ExceptionDWT) Function() uint8 {
+	return pkt.function
+}
+
+func (pkt ExceptionDWT) String() string {
+	return fmt.Sprintf("Exception %d %s", pkt.number, excpFunctions[pkt.function])
+}
+
+func (pkt PCSampleDWT) PC() uint32 {
+	return pkt.pc
+}
+
+func (pkt PCSampleDWT) Sleep() bool {
+	return pkt.sleep
+}
+
+func (pkt PCSampleDWT) String() string {
+	if pkt.sleep {
+		return "PC Sample: Sleep"
+	}
+	return fmt.Sprintf("PC Sample: 0x%08x", pkt.pc)
+}
+
+// ID returns the DWT discriminator, which selects the kind of data trace
+// packet and its comparator.
+func (pkt DataTraceDWT) ID() uint8 {
+	return pkt.id
+}
+
+// Comparator returns the DWT comparator that matched.
+func (pkt DataTraceDWT) Comparator() uint8 {
+	return pkt.comparator
+}
+
+func (pkt DataTraceDWT) Payload() uint32 {
+	return pkt.payload
+}
+
+// Size returns the payload size in bytes.
+func (pkt DataTraceDWT) Size() uint8 {
+	return pkt.size
+}
+
+// IsPC reports whether the payload is the PC of the matching access.
+func (pkt DataTraceDWT) IsPC() bool {
+	return pkt.id < 16 && pkt.id&0x1 == 0
+}
+
+// IsAddress reports whether the payload is the low 16 bits of the data
+// address.
+func (pkt DataTraceDWT) IsAddress() bool {
+	return pkt.id < 16 && pkt.id&0x1 == 1
+}
+
+// Write reports whether a data value packet was for a write access.
+func (pkt DataTraceDWT) Write() bool {
+	return pkt.id >= 16 && pkt.id&0x1 == 1
+}
+
+func (pkt DataTraceDWT) String() string {
+	switch {
+	case pkt.IsPC():
+		return fmt.Sprintf("Data Trace PC: Comparator %d PC: 0x%08x", pkt.comparator, pkt.payload)
+	case pkt.IsAddress():
+		return fmt.Sprintf("Data Trace Address: Comparator %d Offset: 0x%04x", pkt.comparator, pkt.payload)
+	case pkt.Write():
+		return fmt.Sprintf("Data Trace Value: Comparator %d Write 0x%0*x", pkt.comparator, 2*pkt.size, pkt.payload)
+	}
+	return fmt.Sprintf("Data Trace Value: Comparator %d Read 0x%0*x", pkt.comparator, 2*pkt.size, pkt.payload)
+}
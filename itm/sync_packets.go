@@ -0,0 +1,211 @@
+package itm
+
+import (
+	"fmt"
+
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Local timestamp TC field
+const (
+	TS_SYNC = iota
+	TS_DELAYED
+	TS_PKT_DELAYED
+	TS_PKT_TS_DELAYED
+)
+
+type SyncITM struct {
+	*GenericTracePacketITM
+}
+
+type OverflowITM struct {
+	*GenericTracePacketITM
+}
+
+type LocalTimestampITM struct {
+	*GenericTracePacketITM
+	tc        uint8
+	timestamp uint32
+}
+
+type GlobalTimestampITM struct {
+	*GenericTracePacketITM
+	format    int
+	timestamp uint64
+	clk_ch    bool
+	wrap      bool
+}
+
+type ExtensionITM struct {
+	*GenericTracePacketITM
+	hardware bool
+	value    uint32
+}
+
+var tcNames = [...]string{
+	"Sync",
+	"Delayed",
+	"Packet Delayed",
+	"Packet and Timestamp Delayed",
+}
+
+func DecodeSync(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	// Any number of further zero bytes may precede the terminating 0x80
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Synchronization", err)
+		}
+
+		if b == 0x80 {
+			return SyncITM{}, nil
+		} else if b != 0x00 {
+			return nil, malformed(reader, header, "Synchronization", fmt.Sprintf("unexpected byte 0x%02x", b))
+		}
+	}
+}
+
+func DecodeOverflow(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return OverflowITM{}, nil
+}
+
+func DecodeLocalTimestamp(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	// Format 2, the timestamp fits in the header
+	if header&0x80 == 0 {
+		return LocalTimestampITM{timestamp: uint32(header>>4) & 0x7}, nil
+	}
+	// Format 1 headers are 0b11TT0000, 0x80-0xb0 are reserved
+	if header&0xc0 != 0xc0 {
+		return nil, reserved(reader, header)
+	}
+
+	pkt := LocalTimestampITM{tc: uint8(header>>4) & 0x3}
+
+	ts, err := readContinuation(reader, 4)
+	if err != nil {
+		return nil, truncated(reader, header, "Local Timestamp", err)
+	}
+	pkt.timestamp = uint32(ts)
+
+	return pkt, nil
+}
+
+func DecodeGlobalTimestamp1(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := GlobalTimestampITM{format: 1}
+
+	for i := 0; i < 4; i++ {
+		ts_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Global Timestamp", err)
+		}
+
+		// The fourth byte only carries five timestamp bits plus status flags
+		if i == 3 {
+			pkt.timestamp |= uint64(ts_byte&0x1f) << 21
+			pkt.clk_ch = ts_byte&0x20 == 0x20
+			pkt.wrap = ts_byte&0x40 == 0x40
+			break
+		}
+
+		pkt.timestamp |= uint64(ts_byte&0x7f) << uint(7*i)
+		if ts_byte&0x80 == 0 {
+			break
+		}
+	}
+	return pkt, nil
+}
+
+func DecodeGlobalTimestamp2(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := GlobalTimestampITM{format: 2}
+
+	ts, err := readContinuation(reader, 6)
+	if err != nil {
+		return nil, truncated(reader, header, "Global Timestamp", err)
+	}
+
+	// Format 2 holds bits [63:26] of the global timestamp
+	pkt.timestamp = ts << 26
+
+	return pkt, nil
+}
+
+func DecodeExtension(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := ExtensionITM{hardware: header&0x4 == 0x4, value: uint32(header>>4) & 0x7}
+
+	if header&0x80 == 0x80 {
+		ext, err := readContinuation(reader, 4)
+		if err != nil {
+			return nil, truncated(reader, header, "Extension", err)
+		}
+		pkt.value |= uint32(ext) << 3
+	}
+	return pkt, nil
+}
+
+func (SyncITM) String() string {
+	return "Sync"
+}
+
+func (OverflowITM) String() string {
+	return "Overflow"
+}
+
+// TC returns the relationship of the timestamp to the packet stream as one
+// of the TS_* constants.
+func (pkt LocalTimestampITM) TC() uint8 {
+	return pkt.tc
+}
+
+func (pkt LocalTimestampITM) Timestamp() uint32 {
+	return pkt.timestamp
+}
+
+func (pkt LocalTimestampITM) String() string {
+	return fmt.Sprintf("Local Timestamp: %d (%s)", pkt.timestamp, tcNames[pkt.tc])
+}
+
+// Timestamp returns the timestamp bits carried by the packet.  Format 1
+// packets hold bits [25:0] and format 2 packets bits [63:26].
+func (pkt GlobalTimestampITM) Timestamp() uint64 {
+	return pkt.timestamp
+}
+
+func (pkt GlobalTimestampITM) Format() int {
+	return pkt.format
+}
+
+// ClkCh reports a format 1 packet sent because the system clock ratio
+// changed.
+func (pkt GlobalTimestampITM) ClkCh() bool {
+	return pkt.clk_ch
+}
+
+// Wrap reports a format 1 packet sent because the high-order timestamp bits
+// changed since the last format 2 packet.
+func (pkt GlobalTimestampITM) Wrap() bool {
+	return pkt.wrap
+}
+
+func (pkt GlobalTimestampITM) String() string {
+	if pkt.format == 2 {
+		return fmt.Sprintf("Global Timestamp 2: 0x%x", pkt.timestamp)
+	}
+	return fmt.Sprintf("Global Timestamp 1: 0x%x ClkCh: %t Wrap: %t", pkt.timestamp, pkt.clk_ch, pkt.wrap)
+}
+
+// Page returns the stimulus port page selected by an ITM extension, the
+// instrumentation port number is Page()*32 plus the packet's Port().
+func (pkt ExtensionITM) Page() uint32 {
+	return pkt.value
+}
+
+func (pkt ExtensionITM) Hardware() bool {
+	return pkt.hardware
+}
+
+func (pkt ExtensionITM) String() string {
+	if pkt.hardware {
+		return fmt.Sprintf("Extension (DWT): 0x%x", pkt.value)
+	}
+	return fmt.Sprintf("Extension: Stimulus Page %d", pkt.value)
+}
@@ -0,0 +1,85 @@
+package itm
+
+import (
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Synchronization is at least 47 zero bits followed by a one, sent as five
+// 0x00 bytes and 0x80.  SWO captures may not contain one at all.
+const (
+	ASYNC_ZEROS = 5
+)
+
+type GenericTracePacketITM struct {
+	// header byte
+}
+
+// DecodePacket decodes a single ITM or DWT packet from an SWO or TPIU
+// demultiplexed stream.
+func DecodePacket(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	switch {
+	case header == 0x00:
+		return DecodeSync(header, reader)
+	case header == 0x70:
+		return DecodeOverflow(header, reader)
+	case header&0x0f == 0x00:
+		return DecodeLocalTimestamp(header, reader)
+	case header == 0x94:
+		return DecodeGlobalTimestamp1(header, reader)
+	case header == 0xb4:
+		return DecodeGlobalTimestamp2(header, reader)
+	case header&0x0b == 0x08:
+		return DecodeExtension(header, reader)
+	case header&0x07 >= 0x01 && header&0x07 <= 0x03:
+		return DecodeInstrumentation(header, reader)
+	case header&0x07 >= 0x05:
+		return DecodeHardwareSource(header, reader)
+	}
+	return nil, reserved(reader, header)
+}
+
+// readPayload reads the 1, 2 or 4 byte little-endian payload selected by the
+// size field in bits[1:0] of a source packet header.
+func readPayload(header byte, reader *pkts.Reader) (uint32, uint8, error) {
+	size := uint8(1 << (header&0x3 - 1))
+
+	var payload uint32
+	for i := uint8(0); i < size; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		payload |= uint32(b) << (8 * i)
+	}
+	return payload, size, nil
+}
+
+// readContinuation reads up to max_bytes bytes of seven bit continuation
+// payload.
+func readContinuation(reader *pkts.Reader, max_bytes int) (uint64, error) {
+	var value uint64
+	for i := 0; i < max_bytes; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value |= uint64(b&0x7f) << uint(7*i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return value, nil
+}
+
+func truncated(reader *pkts.Reader, header byte, packet string, err error) error {
+	return &pkts.TruncatedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: packet, Err: err}
+}
+
+func reserved(reader *pkts.Reader, header byte) error {
+	return &pkts.ReservedHeaderError{Offset: reader.PacketOffset(), Header: header}
+}
+
+func malformed(reader *pkts.Reader, header byte, packet string, reason string) error {
+	return &pkts.MalformedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: packet, Reason: reason}
+}
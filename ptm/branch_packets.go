@@ -0,0 +1,88 @@
+package ptm
+
+import (
+	"fmt"
+
+	armtrace "github.com/nickjones/etm/armtrace"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type AtomPTM struct {
+	*GenericTracePacketPTM
+	taken bool
+}
+
+type BranchAddrPTM struct {
+	*GenericTracePacketPTM
+	armtrace.BranchAddr
+}
+
+type WaypointPTM struct {
+	*GenericTracePacketPTM
+	armtrace.BranchAddr
+}
+
+type ExceptionReturnPTM struct {
+	*GenericTracePacketPTM
+}
+
+func DecodeAtom(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return AtomPTM{taken: header&0x2 == 0}, nil
+}
+
+func DecodeBranchAddr(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	addr, err := armtrace.DecodeBranchAddr(header, reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Branch Address", err)
+	}
+	return BranchAddrPTM{BranchAddr: addr}, nil
+}
+
+func DecodeWaypoint(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	addr_byte, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "Waypoint Update", err)
+	}
+
+	// Waypoint address bytes use the Branch Address layout
+	addr, err := armtrace.DecodeAddress(addr_byte|0x1, reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Waypoint Update", err)
+	}
+	return WaypointPTM{BranchAddr: addr}, nil
+}
+
+func DecodeExceptionReturn(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return ExceptionReturnPTM{}, nil
+}
+
+func (pkt AtomPTM) Taken() bool {
+	return pkt.taken
+}
+
+func (pkt AtomPTM) String() string {
+	if pkt.taken {
+		return "Branch(es): T "
+	}
+	return "Branch(es): NT "
+}
+
+func (pkt BranchAddrPTM) String() string {
+	field, bits := pkt.Bits()
+	if excp, ok := pkt.Exception(); ok {
+		return fmt.Sprintf("Branch Address: Offset = 0x%x (%d-bit) Exception: %d NS: %t", field, bits, excp, pkt.NS())
+	}
+	return fmt.Sprintf("Branch Address: Offset = 0x%x (%d-bit)", field, bits)
+}
+
+// Waypoint marks the packet as an armtrace.WaypointPacket.
+func (WaypointPTM) Waypoint() {}
+
+func (pkt WaypointPTM) String() string {
+	field, bits := pkt.Bits()
+	return fmt.Sprintf("Waypoint Update: Offset = 0x%x (%d-bit)", field, bits)
+}
+
+func (ExceptionReturnPTM) String() string {
+	return "Exception Return"
+}
@@ -0,0 +1,163 @@
+package ptm
+
+import (
+	"bytes"
+	"fmt"
+
+	armtrace "github.com/nickjones/etm/armtrace"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+type AsyncPTM struct {
+	*GenericTracePacketPTM
+}
+
+type ISyncPTM struct {
+	*GenericTracePacketPTM
+	armtrace.ISync
+}
+
+type TriggerPTM struct {
+	*GenericTracePacketPTM
+}
+
+type ContextIDPTM struct {
+	*GenericTracePacketPTM
+	cid uint32
+}
+
+type VMIDPTM struct {
+	*GenericTracePacketPTM
+	vmid uint8
+}
+
+type TimestampPTM struct {
+	*GenericTracePacketPTM
+	timestamp         uint64
+	cycle_count_valid bool
+	cycle_count       uint32
+}
+
+type IgnorePTM struct {
+	*GenericTracePacketPTM
+}
+
+func DecodeAsync(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	if err := armtrace.ReadAsync(header, reader); err != nil {
+		return nil, err
+	}
+	return AsyncPTM{}, nil
+}
+
+func DecodeISync(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := ISyncPTM{}
+
+	if err := pkt.ReadAddress(reader, false); err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+	if _, err := pkt.ReadInfo(reader); err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+	if err := pkt.ReadContextID(reader); err != nil {
+		return nil, truncated(reader, header, "I-sync", err)
+	}
+	return pkt, nil
+}
+
+func DecodeTrigger(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return TriggerPTM{}, nil
+}
+
+func DecodeContextID(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	cid, err := armtrace.ReadContextID(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Context ID", err)
+	}
+	return ContextIDPTM{cid: cid}, nil
+}
+
+func DecodeVMID(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	vmid, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "VMID", err)
+	}
+	return VMIDPTM{vmid: uint8(vmid)}, nil
+}
+
+func DecodeTimestamp(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	pkt := TimestampPTM{}
+
+	if header&0x4 == 0x4 {
+		pkt.cycle_count_valid = true
+	}
+
+	timestamp, err := armtrace.ReadTimestamp(reader)
+	if err != nil {
+		return nil, truncated(reader, header, "Timestamp", err)
+	}
+	pkt.timestamp = timestamp
+
+	if pkt.cycle_count_valid {
+		count, err := armtrace.ReadCycleCount(reader)
+		if err != nil {
+			return nil, truncated(reader, header, "Timestamp", err)
+		}
+		pkt.cycle_count = count
+	}
+	return pkt, nil
+}
+
+func DecodeIgnore(header byte, reader *pkts.Reader) (pkts.TracePacket, error) {
+	return IgnorePTM{}, nil
+}
+
+func (AsyncPTM) String() string {
+	return "A-sync"
+}
+
+func (TriggerPTM) String() string {
+	return "Trigger"
+}
+
+func (pkt ContextIDPTM) ContextID() uint32 {
+	return pkt.cid
+}
+
+func (pkt ContextIDPTM) String() string {
+	return fmt.Sprintf("Context ID: %x", pkt.cid)
+}
+
+func (pkt VMIDPTM) VMID() uint8 {
+	return pkt.vmid
+}
+
+func (pkt VMIDPTM) String() string {
+	return fmt.Sprintf("VMID: %x", pkt.vmid)
+}
+
+func (pkt TimestampPTM) Timestamp() uint64 {
+	return pkt.timestamp
+}
+
+func (pkt TimestampPTM) CycleCountValid() bool {
+	return pkt.cycle_count_valid
+}
+
+func (pkt TimestampPTM) CycleCount() uint32 {
+	return pkt.cycle_count
+}
+
+func (pkt TimestampPTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Timestamp: 0x%x", pkt.timestamp))
+
+	if pkt.cycle_count_valid {
+		buffer.WriteString(fmt.Sprintf(" Cycle Count: 0x%x", pkt.cycle_count))
+	}
+	return buffer.String()
+}
+
+func (IgnorePTM) String() string {
+	return "Ignore"
+}
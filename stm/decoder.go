@@ -0,0 +1,345 @@
+package stm
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// ASYNC is at least 21 0xf nibbles followed by a 0x0 nibble
+const (
+	ASYNC_NIBBLES = 21
+)
+
+// Timestamp encodings selected by the VERSION packet
+const (
+	VERSION_STPV2_NATURAL = 3
+	VERSION_STPV2_GRAY    = 4
+)
+
+// Decoder decodes a System Trace Protocol v2 stream produced by an STM.
+// STP is nibble oriented and stateful: master, channel and timestamp values
+// persist between packets, so each data packet is reported with the master
+// and channel it was written to and the full timestamp.
+type Decoder struct {
+	nibbles    *NibbleReader
+	synced     bool
+	master     uint16
+	channel    uint16
+	gray       bool
+	timestamp  uint64
+	ts_valid   bool
+	pkt_offset int64
+	header     byte
+}
+
+func NewDecoder(in io.Reader) *Decoder {
+	return &Decoder{nibbles: NewNibbleReader(in)}
+}
+
+// Next returns the next packet in the stream, or io.EOF once the stream is
+// exhausted.  Nibbles ahead of the first ASYNC are discarded.  A packet error
+// drops the decoder out of sync, skipping to the next ASYNC.
+func (d *Decoder) Next() (pkts.TracePacket, error) {
+	if !d.synced {
+		if err := d.sync(); err != nil {
+			return nil, err
+		}
+		d.synced = true
+		return AsyncSTM{}, nil
+	}
+
+	d.pkt_offset = d.nibbles.Offset()
+	op, err := d.nibbles.ReadNibble()
+	if err != nil {
+		return nil, err
+	}
+	d.header = op
+
+	pkt, err := d.decodeOp1(op)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &pkts.TruncatedPacketError{Offset: d.pkt_offset, Header: d.header, Packet: "STP", Err: io.ErrUnexpectedEOF}
+	}
+	if pkts.IsPacketError(err) {
+		d.synced = false
+	}
+	return pkt, err
+}
+
+// Errors carry the last two opcode nibbles read as the header, 0xfN for
+// two-nibble opcodes and 0x0N for the 0xf0N ones.
+func (d *Decoder) reserved() error {
+	return &pkts.ReservedHeaderError{Offset: d.pkt_offset, Header: d.header}
+}
+
+func (d *Decoder) malformed(reason string) error {
+	return &pkts.MalformedPacketError{Offset: d.pkt_offset, Header: d.header, Packet: "STP", Reason: reason}
+}
+
+func (d *Decoder) sync() error {
+	log.Debugln("Synchronizing STP stream.  Looking for ASYNC")
+
+	f_count := 0
+	for {
+		offset := d.nibbles.Offset()
+		nibble, err := d.nibbles.ReadNibble()
+		if err != nil {
+			return err
+		}
+
+		if nibble == 0xf {
+			if f_count == 0 {
+				d.pkt_offset = offset
+			}
+			f_count++
+		} else if nibble == 0x0 && f_count >= ASYNC_NIBBLES {
+			d.reset()
+			return nil
+		} else {
+			f_count = 0
+		}
+	}
+}
+
+// PacketOffset returns the input offset of the byte holding the first nibble
+// of the last packet read.
+func (d *Decoder) PacketOffset() int64 {
+	return d.pkt_offset
+}
+
+// Timestamp returns the full timestamp reconstructed so far, or false before
+// the first timestamped packet.
+func (d *Decoder) Timestamp() (uint64, bool) {
+	return d.timestamp, d.ts_valid
+}
+
+func (d *Decoder) reset() {
+	d.master = 0
+	d.channel = 0
+}
+
+func (d *Decoder) decodeOp1(op byte) (pkts.TracePacket, error) {
+	switch {
+	case op == 0x0:
+		return NullSTM{}, nil
+	case op == 0x1:
+		master, err := d.nibbles.ReadNibbles(2)
+		if err != nil {
+			return nil, err
+		}
+		d.master = uint16(master)
+		d.channel = 0
+		return MasterSTM{master: d.master}, nil
+	case op == 0x2:
+		return d.decodeError(false)
+	case op == 0x3:
+		channel, err := d.nibbles.ReadNibbles(2)
+		if err != nil {
+			return nil, err
+		}
+		d.channel = d.channel&0xff00 | uint16(channel)
+		return ChannelSTM{master: d.master, channel: d.channel}, nil
+	case op >= 0x4 && op <= 0x7:
+		return d.decodeData(8<<(op-0x4), false, false)
+	case op >= 0x8 && op <= 0xb:
+		return d.decodeData(8<<(op-0x8), true, true)
+	case op == 0xc:
+		return d.decodeData(4, false, false)
+	case op == 0xd:
+		return d.decodeData(4, true, true)
+	case op == 0xe:
+		return d.decodeFlag(true)
+	}
+
+	op2, err := d.nibbles.ReadNibble()
+	if err != nil {
+		return nil, err
+	}
+	d.header = op<<4 | op2
+	return d.decodeOp2(op2)
+}
+
+func (d *Decoder) decodeOp2(op byte) (pkts.TracePacket, error) {
+	switch {
+	case op == 0x0:
+		op3, err := d.nibbles.ReadNibble()
+		if err != nil {
+			return nil, err
+		}
+		d.header = op3
+		return d.decodeOp3(op3)
+	case op == 0x1:
+		master, err := d.nibbles.ReadNibbles(4)
+		if err != nil {
+			return nil, err
+		}
+		d.master = uint16(master)
+		d.channel = 0
+		return MasterSTM{master: d.master}, nil
+	case op == 0x2:
+		return d.decodeError(true)
+	case op == 0x3:
+		channel, err := d.nibbles.ReadNibbles(4)
+		if err != nil {
+			return nil, err
+		}
+		d.channel = uint16(channel)
+		return ChannelSTM{master: d.master, channel: d.channel}, nil
+	case op >= 0x4 && op <= 0x7:
+		return d.decodeData(8<<(op-0x4), false, true)
+	case op >= 0x8 && op <= 0xb:
+		return d.decodeData(8<<(op-0x8), true, false)
+	case op == 0xc:
+		return d.decodeData(4, false, true)
+	case op == 0xd:
+		return d.decodeData(4, true, false)
+	case op == 0xe:
+		return d.decodeFlag(false)
+	}
+
+	// Remainder of ASYNC, 0xff already consumed
+	for f_count := 2; ; f_count++ {
+		nibble, err := d.nibbles.ReadNibble()
+		if err != nil {
+			return nil, err
+		}
+		if nibble == 0x0 {
+			if f_count < ASYNC_NIBBLES {
+				return nil, d.malformed(fmt.Sprintf("short ASYNC, %d 0xf nibbles", f_count))
+			}
+			break
+		} else if nibble != 0xf {
+			return nil, d.malformed(fmt.Sprintf("unexpected nibble 0x%x in ASYNC", nibble))
+		}
+	}
+	d.reset()
+	return AsyncSTM{}, nil
+}
+
+func (d *Decoder) decodeOp3(op byte) (pkts.TracePacket, error) {
+	switch op {
+	case 0x0:
+		version, err := d.nibbles.ReadNibble()
+		if err != nil {
+			return nil, err
+		}
+		d.gray = version == VERSION_STPV2_GRAY
+		return VersionSTM{version: uint8(version)}, nil
+	case 0x1:
+		pkt := NullSTM{ts_valid: true}
+		var err error
+		pkt.timestamp, err = d.readTimestamp()
+		return pkt, err
+	case 0x6, 0x7:
+		pkt := TriggerSTM{}
+		value, err := d.nibbles.ReadNibbles(2)
+		if err != nil {
+			return nil, err
+		}
+		pkt.value = uint8(value)
+		if op == 0x7 {
+			pkt.ts_valid = true
+			pkt.timestamp, err = d.readTimestamp()
+		}
+		return pkt, err
+	case 0x8, 0x9:
+		pkt := FreqSTM{}
+		freq, err := d.nibbles.ReadNibbles(8)
+		if err != nil {
+			return nil, err
+		}
+		pkt.freq = uint32(freq)
+		if op == 0x9 {
+			pkt.ts_valid = true
+			pkt.timestamp, err = d.readTimestamp()
+		}
+		return pkt, err
+	}
+	return nil, d.reserved()
+}
+
+func (d *Decoder) decodeError(global bool) (pkts.TracePacket, error) {
+	value, err := d.nibbles.ReadNibbles(2)
+	if err != nil {
+		return nil, err
+	}
+	return ErrorSTM{global: global, value: uint8(value)}, nil
+}
+
+func (d *Decoder) decodeData(size uint8, marked bool, ts bool) (pkts.TracePacket, error) {
+	pkt := DataSTM{master: d.master, channel: d.channel, size: size, marked: marked}
+
+	var err error
+	pkt.value, err = d.nibbles.ReadNibbles(int(size / 4))
+	if err != nil {
+		return nil, err
+	}
+
+	if ts {
+		pkt.ts_valid = true
+		pkt.timestamp, err = d.readTimestamp()
+	}
+	return pkt, err
+}
+
+func (d *Decoder) decodeFlag(ts bool) (pkts.TracePacket, error) {
+	pkt := FlagSTM{master: d.master, channel: d.channel}
+
+	var err error
+	if ts {
+		pkt.ts_valid = true
+		pkt.timestamp, err = d.readTimestamp()
+	}
+	return pkt, err
+}
+
+// readTimestamp reads a length-prefixed timestamp and merges it into the
+// low-order bits of the previous one.
+func (d *Decoder) readTimestamp() (uint64, error) {
+	length, err := d.nibbles.ReadNibble()
+	if err != nil {
+		return 0, err
+	}
+
+	count := int(length)
+	switch length {
+	case 0xd:
+		count = 14
+	case 0xe:
+		count = 16
+	case 0xf:
+		return 0, d.malformed(fmt.Sprintf("reserved timestamp length 0x%x", length))
+	}
+
+	value, err := d.nibbles.ReadNibbles(count)
+	if err != nil {
+		return 0, err
+	}
+
+	mask := ^uint64(0)
+	if count < 16 {
+		mask = uint64(1)<<uint(4*count) - 1
+	}
+
+	if d.gray {
+		merged := (binToGray(d.timestamp) &^ mask) | value
+		d.timestamp = grayToBin(merged)
+	} else {
+		d.timestamp = (d.timestamp &^ mask) | value
+	}
+	d.ts_valid = true
+	return d.timestamp, nil
+}
+
+func binToGray(value uint64) uint64 {
+	return value ^ (value >> 1)
+}
+
+func grayToBin(value uint64) uint64 {
+	for shift := uint(1); shift < 64; shift <<= 1 {
+		value ^= value >> shift
+	}
+	return value
+}
@@ -0,0 +1,59 @@
+package stm
+
+import (
+	"bufio"
+	"io"
+)
+
+// NibbleReader splits a byte stream into STP nibbles, low nibble first.
+type NibbleReader struct {
+	reader *bufio.Reader
+	next   byte
+	valid  bool
+	offset int64
+}
+
+func NewNibbleReader(in io.Reader) *NibbleReader {
+	return &NibbleReader{reader: bufio.NewReader(in)}
+}
+
+func (nr *NibbleReader) ReadNibble() (byte, error) {
+	if nr.valid {
+		nr.valid = false
+		return nr.next, nil
+	}
+
+	b, err := nr.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	nr.offset++
+
+	nr.next = b >> 4
+	nr.valid = true
+	return b & 0xf, nil
+}
+
+// ReadNibbles reads count nibbles, most significant nibble first.
+func (nr *NibbleReader) ReadNibbles(count int) (uint64, error) {
+	var value uint64
+	for i := 0; i < count; i++ {
+		nibble, err := nr.ReadNibble()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value = value<<4 | uint64(nibble)
+	}
+	return value, nil
+}
+
+// Offset returns the input offset of the byte holding the next nibble.
+func (nr *NibbleReader) Offset() int64 {
+	if nr.valid {
+		return nr.offset - 1
+	}
+	return nr.offset
+}
@@ -0,0 +1,228 @@
+package stm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type GenericTracePacketSTM struct {
+	// opcode
+}
+
+type AsyncSTM struct {
+	*GenericTracePacketSTM
+}
+
+type VersionSTM struct {
+	*GenericTracePacketSTM
+	version uint8
+}
+
+type NullSTM struct {
+	*GenericTracePacketSTM
+	ts_valid  bool
+	timestamp uint64
+}
+
+type MasterSTM struct {
+	*GenericTracePacketSTM
+	master uint16
+}
+
+type ChannelSTM struct {
+	*GenericTracePacketSTM
+	master  uint16
+	channel uint16
+}
+
+type ErrorSTM struct {
+	*GenericTracePacketSTM
+	global bool
+	value  uint8
+}
+
+type DataSTM struct {
+	*GenericTracePacketSTM
+	master    uint16
+	channel   uint16
+	size      uint8
+	value     uint64
+	marked    bool
+	ts_valid  bool
+	timestamp uint64
+}
+
+type FlagSTM struct {
+	*GenericTracePacketSTM
+	master    uint16
+	channel   uint16
+	ts_valid  bool
+	timestamp uint64
+}
+
+type TriggerSTM struct {
+	*GenericTracePacketSTM
+	value     uint8
+	ts_valid  bool
+	timestamp uint64
+}
+
+type FreqSTM struct {
+	*GenericTracePacketSTM
+	freq      uint32
+	ts_valid  bool
+	timestamp uint64
+}
+
+func timestampString(buffer *bytes.Buffer, valid bool, timestamp uint64) {
+	if valid {
+		buffer.WriteString(fmt.Sprintf(" TS: 0x%x", timestamp))
+	}
+}
+
+func (AsyncSTM) String() string {
+	return "Async"
+}
+
+func (pkt VersionSTM) Version() uint8 {
+	return pkt.version
+}
+
+func (pkt VersionSTM) String() string {
+	return fmt.Sprintf("Version: %d", pkt.version)
+}
+
+func (pkt NullSTM) Timestamp() (uint64, bool) {
+	return pkt.timestamp, pkt.ts_valid
+}
+
+func (pkt NullSTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("Null")
+	timestampString(&buffer, pkt.ts_valid, pkt.timestamp)
+
+	return buffer.String()
+}
+
+func (pkt MasterSTM) Master() uint16 {
+	return pkt.master
+}
+
+func (pkt MasterSTM) String() string {
+	return fmt.Sprintf("Master: %d", pkt.master)
+}
+
+func (pkt ChannelSTM) Master() uint16 {
+	return pkt.master
+}
+
+func (pkt ChannelSTM) Channel() uint16 {
+	return pkt.channel
+}
+
+func (pkt ChannelSTM) String() string {
+	return fmt.Sprintf("Master: %d Channel: %d", pkt.master, pkt.channel)
+}
+
+// Global reports whether this is a GERR rather than a per-master MERR.
+func (pkt ErrorSTM) Global() bool {
+	return pkt.global
+}
+
+func (pkt ErrorSTM) Value() uint8 {
+	return pkt.value
+}
+
+func (pkt ErrorSTM) String() string {
+	if pkt.global {
+		return fmt.Sprintf("Global Error: 0x%02x", pkt.value)
+	}
+	return fmt.Sprintf("Master Error: 0x%02x", pkt.value)
+}
+
+func (pkt DataSTM) Master() uint16 {
+	return pkt.master
+}
+
+func (pkt DataSTM) Channel() uint16 {
+	return pkt.channel
+}
+
+// Size returns the payload width in bits: 4, 8, 16, 32 or 64.
+func (pkt DataSTM) Size() uint8 {
+	return pkt.size
+}
+
+func (pkt DataSTM) Value() uint64 {
+	return pkt.value
+}
+
+// Marked reports whether the write was to a marked (guaranteed) address.
+func (pkt DataSTM) Marked() bool {
+	return pkt.marked
+}
+
+func (pkt DataSTM) Timestamp() (uint64, bool) {
+	return pkt.timestamp, pkt.ts_valid
+}
+
+func (pkt DataSTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("D%d: M%d C%d Value: 0x%0*x", pkt.size, pkt.master, pkt.channel, pkt.size/4, pkt.value))
+
+	if pkt.marked {
+		buffer.WriteString(" Marked")
+	}
+	timestampString(&buffer, pkt.ts_valid, pkt.timestamp)
+
+	return buffer.String()
+}
+
+func (pkt FlagSTM) Timestamp() (uint64, bool) {
+	return pkt.timestamp, pkt.ts_valid
+}
+
+func (pkt FlagSTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Flag: M%d C%d", pkt.master, pkt.channel))
+	timestampString(&buffer, pkt.ts_valid, pkt.timestamp)
+
+	return buffer.String()
+}
+
+func (pkt TriggerSTM) Value() uint8 {
+	return pkt.value
+}
+
+func (pkt TriggerSTM) Timestamp() (uint64, bool) {
+	return pkt.timestamp, pkt.ts_valid
+}
+
+func (pkt TriggerSTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Trigger: 0x%02x", pkt.value))
+	timestampString(&buffer, pkt.ts_valid, pkt.timestamp)
+
+	return buffer.String()
+}
+
+func (pkt FreqSTM) Frequency() uint32 {
+	return pkt.freq
+}
+
+func (pkt FreqSTM) Timestamp() (uint64, bool) {
+	return pkt.timestamp, pkt.ts_valid
+}
+
+func (pkt FreqSTM) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Frequency: %d Hz", pkt.freq))
+	timestampString(&buffer, pkt.ts_valid, pkt.timestamp)
+
+	return buffer.String()
+}
@@ -0,0 +1,261 @@
+package topology
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	etf "github.com/nickjones/etm/etf"
+	pkts "github.com/nickjones/etm/tracepkts"
+)
+
+// Source is one trace source of a CoreSight system, feeding the formatter
+// under its own trace ID.
+type Source struct {
+	name     string
+	trace_id uint64
+	protocol string
+	cpu      int
+	config   *pkts.Config
+}
+
+// Topology names the trace sources sharing an ETF/ETR/TPIU formatter.
+type Topology struct {
+	sources []Source
+}
+
+// Protocols a Source may use, as accepted by the -protocol flag
+var PROTOCOLS = []string{"etmv4", "ete", "ptm", "etmv3", "stm", "itm"}
+
+// Load reads a topology file.  Files ending .yaml or .yml are read as YAML,
+// anything else as JSON.  Config paths in the file are relative to it.
+//
+// JSON:
+//
+//	{"sources": [{"name": "cpu0", "trace_id": "0x10", "protocol": "etmv4", "cpu": 0}]}
+//
+// YAML, only a list of flat mappings is understood:
+//
+//	sources:
+//	  - name: cpu0
+//	    trace_id: 0x10
+//	    protocol: etmv4
+//	    cpu: 0
+//	    config: cpu0.regs
+func Load(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		entries, err = parseYAML(data)
+	default:
+		entries, err = parseJSON(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("topology: %s: %v", path, err)
+	}
+
+	topo, err := build(entries, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("topology: %s: %v", path, err)
+	}
+	return topo, nil
+}
+
+// FromSysfs describes the ETMs and ETEs of a sysfs snapshot, named after their
+// CPUs.
+func FromSysfs(etms []pkts.SysfsSource) *Topology {
+	topo := &Topology{}
+	for _, etm := range etms {
+		name := etm.Name()
+		if etm.CPU() >= 0 {
+			name = fmt.Sprintf("cpu%d", etm.CPU())
+		}
+		topo.sources = append(topo.sources, Source{name: name, trace_id: etm.TraceID(), protocol: strings.ToLower(etm.Protocol().String()), cpu: etm.CPU(), config: etm.Config()})
+	}
+	return topo
+}
+
+func parseJSON(data []byte) ([]map[string]string, error) {
+	var file struct {
+		Sources []map[string]interface{} `json:"sources"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]string
+	for _, source := range file.Sources {
+		entry := make(map[string]string)
+		for key, value := range source {
+			entry[key] = fmt.Sprint(value)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func parseYAML(data []byte) ([]map[string]string, error) {
+	var entries []map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line_num := 1; scanner.Scan(); line_num++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line == "sources:" || line == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "-") {
+			entries = append(entries, make(map[string]string))
+			line = strings.TrimSpace(line[1:])
+			if line == "" {
+				continue
+			}
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("line %d: expected a list of sources", line_num)
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", line_num)
+		}
+		entries[len(entries)-1][strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return entries, scanner.Err()
+}
+
+func build(entries []map[string]string, dir string) (*Topology, error) {
+	topo := &Topology{}
+	ids := make(map[uint64]bool)
+
+	for i, entry := range entries {
+		source := Source{name: entry["name"], protocol: strings.ToLower(entry["protocol"]), cpu: -1}
+
+		trace_id, err := strconv.ParseUint(entry["trace_id"], 0, 7)
+		if err != nil {
+			return nil, fmt.Errorf("source %d: trace_id: %v", i, err)
+		}
+		if etf.ReservedID(trace_id) {
+			return nil, fmt.Errorf("source %d: trace ID 0x%x is reserved by the formatter", i, trace_id)
+		}
+		if ids[trace_id] {
+			return nil, fmt.Errorf("source %d: trace ID 0x%x used twice", i, trace_id)
+		}
+		ids[trace_id] = true
+		source.trace_id = trace_id
+
+		if source.protocol == "" {
+			source.protocol = "etmv4"
+		}
+		if !knownProtocol(source.protocol) {
+			return nil, fmt.Errorf("source %d: unknown protocol %q", i, entry["protocol"])
+		}
+
+		if cpu, ok := entry["cpu"]; ok {
+			n, err := strconv.Atoi(cpu)
+			if err != nil {
+				return nil, fmt.Errorf("source %d: cpu: %v", i, err)
+			}
+			source.cpu = n
+		}
+
+		if path, ok := entry["config"]; ok {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			source.config, err = pkts.LoadConfigFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("source %d: %v", i, err)
+			}
+		}
+
+		if source.name == "" {
+			source.name = source.defaultName()
+		}
+		topo.sources = append(topo.sources, source)
+	}
+	return topo, nil
+}
+
+func knownProtocol(protocol string) bool {
+	for _, known := range PROTOCOLS {
+		if protocol == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Source) defaultName() string {
+	if s.cpu >= 0 {
+		return fmt.Sprintf("cpu%d", s.cpu)
+	}
+	return fmt.Sprintf("%s-0x%02x", s.protocol, s.trace_id)
+}
+
+func (t *Topology) Sources() []Source {
+	return t.sources
+}
+
+// Source returns the source using trace ID id.
+func (t *Topology) Source(id uint64) (Source, bool) {
+	for _, source := range t.sources {
+		if source.trace_id == id {
+			return source, true
+		}
+	}
+	return Source{}, false
+}
+
+// SetConfig gives every source without a configuration of its own the one
+// of the same trace ID in configs.
+func (t *Topology) SetConfig(configs map[uint64]*pkts.Config) {
+	for i := range t.sources {
+		if t.sources[i].config == nil {
+			t.sources[i].config = configs[t.sources[i].trace_id]
+		}
+	}
+}
+
+func (s Source) Name() string {
+	return s.name
+}
+
+func (s Source) TraceID() uint64 {
+	return s.trace_id
+}
+
+// Protocol returns the trace protocol, one of PROTOCOLS.
+func (s Source) Protocol() string {
+	return s.protocol
+}
+
+// CPU returns the CPU traced by the source, or -1 for sources such as STM
+// that aren't tied to one.
+func (s Source) CPU() int {
+	return s.cpu
+}
+
+// Config returns the trace unit configuration of the source, nil when none
+// was given.
+func (s Source) Config() *pkts.Config {
+	return s.config
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%s: trace ID 0x%x %s CPU %d", s.name, s.trace_id, s.protocol, s.cpu)
+}
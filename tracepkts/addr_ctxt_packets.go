@@ -1,10 +1,8 @@
 package tracepkts
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
-	"log"
 )
 
 type Long64bAddrETMv4 struct {
@@ -47,53 +45,81 @@ type ContextETMv4 struct {
 	vmid          uint32
 	cid_valid     bool
 	cid           uint32
+	vmid_bytes    int
+	cid_bytes     int
 }
 
-func DecodeExactAddr(header byte, reader *bufio.Reader) TracePacket {
-	pkt := ExactAddrETMv4{}
+func DecodeExactAddr(header byte, reader *Reader) (TracePacket, error) {
+	pkt := ExactAddrETMv4{GenericTracePacketv4: reader.generic()}
 
-	entry := uint(header&0x03)
+	entry := uint(header & 0x03)
+	if entry >= ADDR_COMP_STK_DEPTH {
+		return nil, reserved(reader, header)
+	}
 	pkt.exact_match[entry] = true
-	return pkt
+	return pkt, nil
 }
 
-func DecodeShortAddr(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CompressedAddrETMv4{width: 8}
+func DecodeShortAddr(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CompressedAddrETMv4{GenericTracePacketv4: reader.generic()}
 
 	if header == 0x95 {
 		pkt.is = 0
 	} else {
 		pkt.is = 1
 	}
+	// A single byte holds address bits [8:2] for IS0 and [7:1] for IS1
+	var err error
+	pkt.offset, pkt.width, err = readShortAddr(header, reader, "Short Address", 2-pkt.is)
+	if err != nil {
+		return nil, err
+	}
 
+	return pkt, nil
+}
+
+// readShortAddr reads the payload of a short address packet, for an address
+// whose low align bits are implied.  The first byte holds seven address bits
+// with bit[7] flagging a second byte, which unlike the long formats is a full
+// eight bits.
+func readShortAddr(header byte, reader *Reader, name string, align uint8) (uint64, uint8, error) {
 	addr_byte, err := reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Short Address packet decode.")
-		return nil
+		return 0, 0, truncated(reader, header, name, err)
 	}
-	addr_int := uint64(addr_byte)
-	pkt.offset = (addr_int & 0x7f) << uint(2-pkt.is)
+	offset := uint64(addr_byte&0x7f) << align
 
-	if addr_byte&0x80 == 0x80 {
-		addr_byte, err = reader.ReadByte()
-		if err != nil {
-			log.Println("Error reading byte for Short Address packet decode.")
-			return nil
-		}
-		addr_int = uint64(addr_byte)
+	if addr_byte&0x80 == 0 {
+		return offset, 7 + align, nil
+	}
 
-		if pkt.is == 0 {
-			addr_int &= 0x7f
+	offset, err = readAddrBytes(header, reader, name, offset, uint(7+align), 1)
+	return offset, 15 + align, err
+}
+
+// readAddrBytes reads n full bytes of an address payload into addr, starting
+// at bit shift.
+func readAddrBytes(header byte, reader *Reader, name string, addr uint64, shift uint, n int) (uint64, error) {
+	for i := 0; i < n; i++ {
+		addr_byte, err := reader.ReadByte()
+		if err != nil {
+			return 0, truncated(reader, header, name, err)
 		}
-		pkt.offset |= addr_int << uint(9-pkt.is)
-		pkt.width = 16
+		addr |= uint64(addr_byte) << (shift + uint(8*i))
 	}
+	return addr, nil
+}
 
-	return pkt
+// addrWithBase replaces the low width bits of base with offset.
+func addrWithBase(base uint64, offset uint64, width uint8) uint64 {
+	if width >= 64 {
+		return offset
+	}
+	return base>>width<<width | offset
 }
 
-func DecodeLong32b(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CompressedAddrETMv4{width: 32}
+func DecodeLong32b(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CompressedAddrETMv4{GenericTracePacketv4: reader.generic(), width: 32}
 
 	if header == 0x9a {
 		pkt.is = 0
@@ -104,16 +130,14 @@ func DecodeLong32b(header byte, reader *bufio.Reader) TracePacket {
 	// First two bytes are special
 	addr_byte, err := reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Long Address 32b packet decode.")
-		return nil
+		return nil, truncated(reader, header, "Long Address 32b", err)
 	}
 	addr_int := uint64(addr_byte)
 	pkt.offset = (addr_int & 0x7f) << uint(2-pkt.is)
 
 	addr_byte, err = reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Long Address 32b packet decode.")
-		return nil
+		return nil, truncated(reader, header, "Long Address 32b", err)
 	}
 	addr_int = uint64(addr_byte)
 
@@ -122,21 +146,16 @@ func DecodeLong32b(header byte, reader *bufio.Reader) TracePacket {
 	}
 	pkt.offset |= addr_int << uint(9-pkt.is)
 
-	for i := 2; i < 4; i++ {
-		addr_byte, err := reader.ReadByte()
-		if err != nil {
-			log.Println("Error reading byte for Long Address 32b packet decode.")
-			return nil
-		}
-		addr_int := uint64(addr_byte)
-		pkt.offset |= addr_int << uint(8*i)
+	pkt.offset, err = readAddrBytes(header, reader, "Long Address 32b", pkt.offset, 16, 2)
+	if err != nil {
+		return nil, err
 	}
 
-	return pkt
+	return pkt, nil
 }
 
-func DecodeLong64b(header byte, reader *bufio.Reader) TracePacket {
-	pkt := Long64bAddrETMv4{width: 64}
+func DecodeLong64b(header byte, reader *Reader) (TracePacket, error) {
+	pkt := Long64bAddrETMv4{GenericTracePacketv4: reader.generic(), width: 64}
 
 	if header == 0x9d {
 		pkt.is = 0
@@ -147,16 +166,14 @@ func DecodeLong64b(header byte, reader *bufio.Reader) TracePacket {
 	// First two bytes are special
 	addr_byte, err := reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Long Address 64b packet decode.")
-		return nil
+		return nil, truncated(reader, header, "Long Address 64b", err)
 	}
 	addr_int := uint64(addr_byte)
 	pkt.address = (addr_int & 0x7f) << uint(2-pkt.is)
 
 	addr_byte, err = reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Long Address 64b packet decode.")
-		return nil
+		return nil, truncated(reader, header, "Long Address 64b", err)
 	}
 	addr_int = uint64(addr_byte)
 
@@ -165,33 +182,29 @@ func DecodeLong64b(header byte, reader *bufio.Reader) TracePacket {
 	}
 	pkt.address |= addr_int << uint(9-pkt.is)
 
-	for i := 2; i < 8; i++ {
-		addr_byte, err := reader.ReadByte()
-		if err != nil {
-			log.Println("Error reading byte for Long Address 64b packet decode.")
-			return nil
-		}
-		addr_int := uint64(addr_byte)
-		pkt.address |= addr_int << uint(8*i)
+	pkt.address, err = readAddrBytes(header, reader, "Long Address 64b", pkt.address, 16, 6)
+	if err != nil {
+		return nil, err
 	}
 
-	return pkt
+	return pkt, nil
 }
 
-func DecodeContext(header byte, reader *bufio.Reader) TracePacket {
-	pkt := ContextETMv4{}
+func DecodeContext(header byte, reader *Reader) (TracePacket, error) {
+	pkt := ContextETMv4{GenericTracePacketv4: reader.generic()}
+	pkt.vmid_bytes = reader.Config().VMIDBytes()
+	pkt.cid_bytes = reader.Config().CIDBytes()
 
 	if header&0x1 == 0 {
 		pkt.payload_valid = false
-		return pkt
+		return pkt, nil
 	} else {
 		pkt.payload_valid = true
 	}
 
 	info_byte, err := reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading byte for Context.")
-		return nil
+		return nil, truncated(reader, header, "Context", err)
 	}
 
 	// Exception Level
@@ -214,15 +227,13 @@ func DecodeContext(header byte, reader *bufio.Reader) TracePacket {
 	// VMID
 	if info_byte&0x40 == 0x40 {
 		pkt.vmid_valid = true
-		vmid := make([]byte, 4) // Expanded to 4B on v4.1
-		count, err := reader.Read(vmid)
-
-		if err != nil || count != 4 {
-			log.Println("Error reading VMID byte for Context.")
-		}
-
-		for k, v := range vmid {
-			pkt.vmid |= uint32(v) << uint(8*k)
+		// Up to 4B since v4.1, TRCIDR2.VMIDSIZE
+		for i := 0; i < pkt.vmid_bytes; i++ {
+			vmid, err := reader.ReadByte()
+			if err != nil {
+				return nil, truncated(reader, header, "Context", err)
+			}
+			pkt.vmid |= uint32(vmid) << uint(8*i)
 		}
 	} else {
 		pkt.vmid_valid = false
@@ -231,28 +242,17 @@ func DecodeContext(header byte, reader *bufio.Reader) TracePacket {
 	// CONTEXTID
 	if info_byte&0x80 == 0x80 {
 		pkt.cid_valid = true
-		var cid []byte
 
-		for i := 0; i < 4; i++ {
-			cids, err := reader.ReadByte()
+		for i := 0; i < pkt.cid_bytes; i++ {
+			cid, err := reader.ReadByte()
 			if err != nil {
-				log.Println("Error reading CONTEXTID bytes for Context.")
-			} else {
-				cid = append(cid, cids)
+				return nil, truncated(reader, header, "Context", err)
 			}
-		}
-
-		if len(cid) != 4 {
-			log.Println("Error: Read CONTEXTID bytes was less than expected 4 bytes.")
-		}
-
-
-		for k, v := range cid {
-			pkt.cid |= uint32(v) << uint(8*k)
+			pkt.cid |= uint32(cid) << uint(8*i)
 		}
 	}
 
-	return pkt
+	return pkt, nil
 }
 
 func (pkt Long64bAddrETMv4) Address() uint64 {
@@ -263,6 +263,10 @@ func (pkt Long64bAddrETMv4) IS() uint8 {
 	return pkt.is
 }
 
+func (pkt Long64bAddrETMv4) Width() uint8 {
+	return pkt.width
+}
+
 func (pkt Long64bAddrETMv4) String() string {
 	return fmt.Sprintf("IS%d Address = 0x%016x (%d-bit)", pkt.is, pkt.address, pkt.width)
 }
@@ -277,7 +281,13 @@ func (pkt CompressedAddrETMv4) StringWithBase(base uint64) string {
 }
 
 func (pkt CompressedAddrETMv4) AddrWithBase(base uint64) uint64 {
-	return ((base >> uint64(pkt.width)) << uint64(pkt.width)) | pkt.offset
+	return addrWithBase(base, pkt.offset, pkt.width)
+}
+
+// PartialAddress returns the low Width() bits of the address carried by the
+// packet, before they're combined with the address stack.
+func (pkt CompressedAddrETMv4) PartialAddress() uint64 {
+	return pkt.offset
 }
 
 func (pkt CompressedAddrETMv4) IS() uint8 {
@@ -312,6 +322,40 @@ func (pkt ExactAddrETMv4) Entry() uint8 {
 	return 0
 }
 
+// PayloadValid is false for a Context packet that repeats the previous
+// context rather than carrying one.
+func (pkt ContextETMv4) PayloadValid() bool {
+	return pkt.payload_valid
+}
+
+func (pkt ContextETMv4) EL() int {
+	return pkt.el
+}
+
+func (pkt ContextETMv4) A64() bool {
+	return pkt.a64
+}
+
+func (pkt ContextETMv4) NS() bool {
+	return pkt.ns
+}
+
+func (pkt ContextETMv4) VMIDValid() bool {
+	return pkt.vmid_valid
+}
+
+func (pkt ContextETMv4) VMID() uint32 {
+	return pkt.vmid
+}
+
+func (pkt ContextETMv4) ContextIDValid() bool {
+	return pkt.cid_valid
+}
+
+func (pkt ContextETMv4) ContextID() uint32 {
+	return pkt.cid
+}
+
 func (pkt ContextETMv4) String() string {
 	if pkt.payload_valid == false {
 		return "Context (no payload)"
@@ -331,3 +375,75 @@ func (pkt ContextETMv4) String() string {
 
 	return buffer.String()
 }
+
+// encodeAddrPayload writes the payload shared by the short and long address
+// packets, where the first two bytes skip the alignment bits of the IS.
+func encodeAddrPayload(address uint64, is uint8, addr_bytes int) []byte {
+	out := []byte{byte(address>>(2-is)) & 0x7f}
+	if addr_bytes == 1 {
+		return out
+	}
+
+	b := byte(address >> (9 - is))
+	if is == 0 {
+		b &= 0x7f
+	}
+	out = append(out, b)
+
+	for i := 2; i < addr_bytes; i++ {
+		out = append(out, byte(address>>uint(8*i)))
+	}
+	return out
+}
+
+func (pkt Long64bAddrETMv4) Encode() []byte {
+	return append([]byte{0x9d + pkt.is}, encodeAddrPayload(pkt.address, pkt.is, 8)...)
+}
+
+func (pkt CompressedAddrETMv4) Encode() []byte {
+	switch pkt.width {
+	case 9 - pkt.is:
+		return append([]byte{0x95 + pkt.is}, encodeAddrPayload(pkt.offset, pkt.is, 1)...)
+	case 17 - pkt.is:
+		offset := pkt.offset >> (2 - pkt.is)
+		return []byte{0x95 + pkt.is, byte(offset&0x7f) | 0x80, byte(offset >> 7)}
+	case 32:
+		return append([]byte{0x9a + pkt.is}, encodeAddrPayload(pkt.offset, pkt.is, 4)...)
+	}
+	return nil
+}
+
+func (pkt ExactAddrETMv4) Encode() []byte {
+	return []byte{0x90 | pkt.Entry()}
+}
+
+func (pkt ContextETMv4) Encode() []byte {
+	if !pkt.payload_valid {
+		return []byte{0x80}
+	}
+
+	info := byte(pkt.el & 0x3)
+	if pkt.a64 {
+		info |= 0x10
+	}
+	if pkt.ns {
+		info |= 0x20
+	}
+	if pkt.vmid_valid {
+		info |= 0x40
+	}
+	if pkt.cid_valid {
+		info |= 0x80
+	}
+
+	// The ID sizes are those the packet was decoded with, a Config can make
+	// either zero
+	out := []byte{0x81, info}
+	if pkt.vmid_valid {
+		out = append(out, littleEndian(uint64(pkt.vmid), pkt.vmid_bytes)...)
+	}
+	if pkt.cid_valid {
+		out = append(out, littleEndian(uint64(pkt.cid), pkt.cid_bytes)...)
+	}
+	return out
+}
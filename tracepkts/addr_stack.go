@@ -0,0 +1,101 @@
+package tracepkts
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+type ETMv4AddressStackElement struct {
+	address uint64
+	is      uint8
+}
+
+// ETMv4AddressStack holds the most recent target addresses, which exact match
+// and compressed address packets are resolved against.  The encoder keeps one
+// in step with the decoder's so the packets it picks resolve to the same
+// addresses.
+type ETMv4AddressStack struct {
+	entries []ETMv4AddressStackElement
+	depth   int
+}
+
+func (e ETMv4AddressStackElement) Address() uint64 {
+	return e.address
+}
+
+func (e ETMv4AddressStackElement) IS() uint8 {
+	return e.is
+}
+
+func (s *ETMv4AddressStack) Push(address uint64, is uint8) {
+	log.Debugf("Pushing addr=0x%016x is=%d\n", address, is)
+	s.entries = append([]ETMv4AddressStackElement{{address, is}}, s.entries...)
+	for i, e := range s.entries {
+		log.Debugf("Addr Stack %d: %#v\n", i, e)
+	}
+	s.Compact()
+}
+
+// Update applies an address packet to the stack and returns the address it
+// resolved to, or false when pkt isn't an address packet.
+func (s *ETMv4AddressStack) Update(pkt TracePacket) (ETMv4AddressStackElement, bool) {
+	var elm ETMv4AddressStackElement
+
+	switch addr_pkt := pkt.(type) {
+	case Long64bAddrETMv4:
+		elm = ETMv4AddressStackElement{addr_pkt.Address(), addr_pkt.IS()}
+
+	case CompressedAddrETMv4:
+		elm = ETMv4AddressStackElement{addr_pkt.AddrWithBase(s.Get(0).address), addr_pkt.IS()}
+
+	case ExactAddrETMv4:
+		elm = s.Get(addr_pkt.Entry())
+
+	case DataAddrETMv4:
+		if addr_pkt.Width() == 64 {
+			elm.address = addr_pkt.AddrWithBase(0)
+		} else {
+			elm.address = addr_pkt.AddrWithBase(s.Get(0).address)
+		}
+
+	case DataExactAddrETMv4:
+		elm = s.Get(addr_pkt.Entry())
+
+	default:
+		return elm, false
+	}
+
+	s.Push(elm.address, elm.is)
+	return elm, true
+}
+
+// SetDepth changes how many addresses are kept, ADDR_COMP_STK_DEPTH by
+// default.
+func (s *ETMv4AddressStack) SetDepth(depth int) {
+	s.depth = depth
+	s.Compact()
+}
+
+func (s *ETMv4AddressStack) Compact() {
+	depth := s.depth
+	if depth == 0 {
+		depth = ADDR_COMP_STK_DEPTH
+	}
+	// Drop oldest address, trace analyzer is required to keep a certain depth
+	for len(s.entries) > depth {
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+}
+
+func (s ETMv4AddressStack) Len() int {
+	return len(s.entries)
+}
+
+// Get returns entry idx, most recent first, or a zero address when the stack
+// doesn't hold that many.  The Decoder rejects exact match packets for
+// missing entries before they get here.
+func (s ETMv4AddressStack) Get(idx uint8) ETMv4AddressStackElement {
+	if len(s.entries) <= int(idx) {
+		return ETMv4AddressStackElement{}
+	}
+	return s.entries[idx]
+}
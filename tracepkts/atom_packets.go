@@ -1,10 +1,8 @@
 package tracepkts
 
 import (
-	"bufio"
 	"fmt"
 	"strings"
-	"log"
 )
 
 const (
@@ -18,6 +16,22 @@ type AtomFmtETMv4 struct {
 	taken []bool
 }
 
+// Atom Format 4 patterns indexed by header bits[1:0]
+var atomFmt4Patterns = [4][]bool{
+	{ATOM_N, ATOM_E, ATOM_E, ATOM_E},
+	{ATOM_N, ATOM_N, ATOM_N, ATOM_N},
+	{ATOM_N, ATOM_E, ATOM_N, ATOM_E},
+	{ATOM_E, ATOM_N, ATOM_E, ATOM_N},
+}
+
+// Atom Format 5 patterns keyed by header bit[5] and bits[1:0]
+var atomFmt5Patterns = map[uint8][]bool{
+	1: {ATOM_N, ATOM_N, ATOM_N, ATOM_N, ATOM_N},
+	2: {ATOM_N, ATOM_E, ATOM_N, ATOM_E, ATOM_N},
+	3: {ATOM_E, ATOM_N, ATOM_E, ATOM_N, ATOM_E},
+	5: {ATOM_N, ATOM_E, ATOM_E, ATOM_E, ATOM_E},
+}
+
 func DecodeAtomFmt1to3(header byte, loop_count int) AtomFmtETMv4 {
 	pkt := AtomFmtETMv4{}
 
@@ -31,64 +45,49 @@ func DecodeAtomFmt1to3(header byte, loop_count int) AtomFmtETMv4 {
 	return pkt
 }
 
-func DecodeAtomFmt1(header byte, reader *bufio.Reader) TracePacket {
+func DecodeAtomFmt1(header byte, reader *Reader) (TracePacket, error) {
 	pkt := DecodeAtomFmt1to3(header, 1)
+	pkt.GenericTracePacketv4 = reader.generic()
 	pkt.format_num = 1
-	return pkt
+	return pkt, nil
 }
 
-func DecodeAtomFmt2(header byte, reader *bufio.Reader) TracePacket {
+func DecodeAtomFmt2(header byte, reader *Reader) (TracePacket, error) {
 	pkt := DecodeAtomFmt1to3(header, 2)
+	pkt.GenericTracePacketv4 = reader.generic()
 	pkt.format_num = 2
-	return pkt
+	return pkt, nil
 }
 
-func DecodeAtomFmt3(header byte, reader *bufio.Reader) TracePacket {
+func DecodeAtomFmt3(header byte, reader *Reader) (TracePacket, error) {
 	pkt := DecodeAtomFmt1to3(header, 3)
+	pkt.GenericTracePacketv4 = reader.generic()
 	pkt.format_num = 3
-	return pkt
+	return pkt, nil
 }
 
-func DecodeAtomFmt4(header byte, reader *bufio.Reader) TracePacket {
-	pkt := AtomFmtETMv4{format_num: 4}
-
-	pkt_cnt := header&0x3
+func DecodeAtomFmt4(header byte, reader *Reader) (TracePacket, error) {
+	pkt := AtomFmtETMv4{GenericTracePacketv4: reader.generic(), format_num: 4}
 
-	switch {
-	case pkt_cnt == 0:
-		pkt.taken = []bool{ATOM_N, ATOM_E, ATOM_E, ATOM_E}
-	case pkt_cnt == 1:
-		pkt.taken = []bool{ATOM_N, ATOM_N, ATOM_N, ATOM_N}
-	case pkt_cnt == 2:
-		pkt.taken = []bool{ATOM_N, ATOM_E, ATOM_N, ATOM_E}
-	case pkt_cnt == 3:
-		pkt.taken = []bool{ATOM_E, ATOM_N, ATOM_E, ATOM_N}
-	}
-	return pkt
+	pkt.taken = append([]bool(nil), atomFmt4Patterns[header&0x3]...)
+	return pkt, nil
 }
 
-func DecodeAtomFmt5(header byte, reader *bufio.Reader) TracePacket {
-	pkt := AtomFmtETMv4{format_num: 5}
+func DecodeAtomFmt5(header byte, reader *Reader) (TracePacket, error) {
+	pkt := AtomFmtETMv4{GenericTracePacketv4: reader.generic(), format_num: 5}
 
-	atom_pattern := ((header>>5)&0x1) | (header&0x3)
+	atom_pattern := ((header>>5)&0x1)<<2 | (header & 0x3)
 
-	switch {
-	case atom_pattern == 1:
-		pkt.taken = []bool{ATOM_N, ATOM_N, ATOM_N, ATOM_N, ATOM_N}
-	case atom_pattern == 2:
-		pkt.taken = []bool{ATOM_N, ATOM_E, ATOM_N, ATOM_E, ATOM_N}
-	case atom_pattern == 3:
-		pkt.taken = []bool{ATOM_E, ATOM_N, ATOM_E, ATOM_N, ATOM_E}
-	case atom_pattern == 5:
-		pkt.taken = []bool{ATOM_N, ATOM_E, ATOM_E, ATOM_E, ATOM_E}
-	default:
-		log.Fatalf("Unexpected Atom Format 5 ABC pattern: 0x%02x\n", atom_pattern)
+	taken, ok := atomFmt5Patterns[atom_pattern]
+	if !ok {
+		return nil, &InvalidAtomPatternError{Offset: reader.PacketOffset(), Header: header, Pattern: atom_pattern}
 	}
-	return pkt
+	pkt.taken = append([]bool(nil), taken...)
+	return pkt, nil
 }
 
-func DecodeAtomFmt6(header byte, reader *bufio.Reader) TracePacket {
-	pkt := AtomFmtETMv4{format_num: 6}
+func DecodeAtomFmt6(header byte, reader *Reader) (TracePacket, error) {
+	pkt := AtomFmtETMv4{GenericTracePacketv4: reader.generic(), format_num: 6}
 
 	a := (header>>5)&0x1
 	count := int(header&0x1f)
@@ -101,17 +100,78 @@ func DecodeAtomFmt6(header byte, reader *bufio.Reader) TracePacket {
 	} else {
 		pkt.taken = append(pkt.taken, ATOM_E)
 	}
-	return pkt
+	return pkt, nil
 }
 
-func (pkt AtomFmtETMv4) String() string {
+func atomString(atoms []bool) string {
 	var sb strings.Builder
-	for _, br := range pkt.taken {
+	for _, br := range atoms {
 		taken := "T"
 		if br == false {
 			taken = "NT"
 		}
 		sb.WriteString(fmt.Sprintf("%s ", taken))
 	}
-	return fmt.Sprintf("Branch(es): %s (Atom Format %d)", sb.String(), pkt.format_num)
+	return sb.String()
+}
+
+func (pkt AtomFmtETMv4) Format() int {
+	return pkt.format_num
+}
+
+// Atoms returns the atoms in trace order, ATOM_E for taken and ATOM_N for
+// not taken.
+func (pkt AtomFmtETMv4) Atoms() []bool {
+	return pkt.taken
+}
+
+func (pkt AtomFmtETMv4) String() string {
+	return fmt.Sprintf("Branch(es): %s (Atom Format %d)", atomString(pkt.taken), pkt.format_num)
+}
+
+func (pkt AtomFmtETMv4) Encode() []byte {
+	var header byte
+	switch pkt.format_num {
+	case 1, 2, 3:
+		if len(pkt.taken) != pkt.format_num {
+			return nil
+		}
+		header = []byte{0, 0xf6, 0xd8, 0xf8}[pkt.format_num]
+		for i, taken := range pkt.taken {
+			if taken == ATOM_E {
+				header |= 1 << uint(i)
+			}
+		}
+	case 4:
+		for i, pattern := range atomFmt4Patterns {
+			if len(pkt.taken) == len(pattern) && atomsHavePrefix(pkt.taken, pattern) {
+				return []byte{0xdc | byte(i)}
+			}
+		}
+		return nil
+	case 5:
+		for i, pattern := range atomFmt5Patterns {
+			if len(pkt.taken) == len(pattern) && atomsHavePrefix(pkt.taken, pattern) {
+				return []byte{0xd4 | (i>>2)<<5 | i&0x3}
+			}
+		}
+		return nil
+	case 6:
+		count := len(pkt.taken) - 3
+		if count < 0 || count > ATOM_FMT6_MAX_COUNT {
+			return nil
+		}
+		for _, taken := range pkt.taken[:count+2] {
+			if taken != ATOM_E {
+				return nil
+			}
+		}
+		header = 0xc0 | byte(count)
+		if pkt.taken[count+2] == ATOM_N {
+			header |= 0x20
+		}
+	default:
+		return nil
+	}
+	return []byte{header}
 }
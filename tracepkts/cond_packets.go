@@ -0,0 +1,380 @@
+package tracepkts
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type CondInstFmt1ETMv4 struct {
+	*GenericTracePacketv4
+	key uint32
+}
+
+type CondInstFmt2ETMv4 struct {
+	*GenericTracePacketv4
+	ci uint8
+}
+
+type CondInstFmt3ETMv4 struct {
+	*GenericTracePacketv4
+	num   uint8
+	final bool
+}
+
+type CondResultFmt1ETMv4 struct {
+	*GenericTracePacketv4
+	ci     []bool
+	key    []uint32
+	result []uint8
+}
+
+type CondResultFmt2ETMv4 struct {
+	*GenericTracePacketv4
+	key_incr uint8
+	result   uint8
+}
+
+type CondResultFmt3ETMv4 struct {
+	*GenericTracePacketv4
+	tokens uint16
+}
+
+type CondResultFmt4ETMv4 struct {
+	*GenericTracePacketv4
+	result uint8
+}
+
+type CondFlushETMv4 struct {
+	*GenericTracePacketv4
+}
+
+// Condition codes as encoded in the cond field of A32/T32/A64 instructions
+const (
+	COND_EQ = iota
+	COND_NE
+	COND_CS
+	COND_CC
+	COND_MI
+	COND_PL
+	COND_VS
+	COND_VC
+	COND_HI
+	COND_LS
+	COND_GE
+	COND_LT
+	COND_GT
+	COND_LE
+	COND_AL
+	COND_NV
+)
+
+// APSR flag bits within a conditional result
+const (
+	APSR_V = 1 << iota
+	APSR_C
+	APSR_Z
+	APSR_N
+)
+
+func DecodeCondInstFmt1(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CondInstFmt1ETMv4{GenericTracePacketv4: reader.generic()}
+
+	for i := 0; i < 5; i++ {
+		key_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Conditional Instruction Format 1", err)
+		}
+
+		pkt.key |= uint32(key_byte&0x7f) << uint(i*7)
+
+		if key_byte&0x80 == 0 {
+			break
+		}
+	}
+	return pkt, nil
+}
+
+func DecodeCondInstFmt2(header byte, reader *Reader) (TracePacket, error) {
+	return CondInstFmt2ETMv4{GenericTracePacketv4: reader.generic(), ci: uint8(header & 0x3)}, nil
+}
+
+func DecodeCondInstFmt3(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CondInstFmt3ETMv4{GenericTracePacketv4: reader.generic()}
+
+	payload, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "Conditional Instruction Format 3", err)
+	}
+
+	if payload&0x1 == 1 {
+		pkt.final = true
+	}
+	pkt.num = uint8(payload>>1) & 0x3f
+
+	return pkt, nil
+}
+
+// decodeCondResult reads a single RESULT/KEY payload shared by the Format 1
+// conditional result packet.
+func decodeCondResult(reader *Reader) (uint32, uint8, error) {
+	payload, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result := uint8(payload & 0xf)
+	key := uint32(payload>>4) & 0x7
+
+	for i := 0; payload&0x80 == 0x80 && i < 4; i++ {
+		payload, err = reader.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		key |= uint32(payload&0x7f) << uint(3+i*7)
+	}
+	return key, result, nil
+}
+
+func DecodeCondResultFmt1(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CondResultFmt1ETMv4{GenericTracePacketv4: reader.generic()}
+
+	// 0b011011xx carries a single RESULT/KEY pair, 0b011010xx carries two
+	count := 2
+	if header&0x4 == 0x4 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		key, result, err := decodeCondResult(reader)
+		if err != nil {
+			return nil, truncated(reader, header, "Conditional Result Format 1", err)
+		}
+		pkt.ci = append(pkt.ci, (header>>uint(i))&0x1 == 1)
+		pkt.key = append(pkt.key, key)
+		pkt.result = append(pkt.result, result)
+	}
+	return pkt, nil
+}
+
+func DecodeCondResultFmt2(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CondResultFmt2ETMv4{GenericTracePacketv4: reader.generic(), key_incr: 1, result: uint8(header & 0x3)}
+
+	if header&0x4 == 0x4 {
+		pkt.key_incr = 2
+	}
+	return pkt, nil
+}
+
+func DecodeCondResultFmt3(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CondResultFmt3ETMv4{GenericTracePacketv4: reader.generic()}
+
+	payload, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "Conditional Result Format 3", err)
+	}
+
+	pkt.tokens = uint16(header&0xf)<<8 | uint16(payload)
+
+	return pkt, nil
+}
+
+func DecodeCondResultFmt4(header byte, reader *Reader) (TracePacket, error) {
+	return CondResultFmt4ETMv4{GenericTracePacketv4: reader.generic(), result: uint8(header & 0x3)}, nil
+}
+
+func DecodeCondFlush(header byte, reader *Reader) (TracePacket, error) {
+	return CondFlushETMv4{GenericTracePacketv4: reader.generic()}, nil
+}
+
+// ConditionPassed evaluates an instruction condition code against the APSR
+// flags reported in a conditional result.
+func ConditionPassed(cond uint8, result uint8) bool {
+	n := result&APSR_N != 0
+	z := result&APSR_Z != 0
+	c := result&APSR_C != 0
+	v := result&APSR_V != 0
+
+	var passed bool
+	switch cond >> 1 {
+	case 0:
+		passed = z
+	case 1:
+		passed = c
+	case 2:
+		passed = n
+	case 3:
+		passed = v
+	case 4:
+		passed = c && !z
+	case 5:
+		passed = n == v
+	case 6:
+		passed = n == v && !z
+	case 7:
+		// AL and NV both always pass
+		return true
+	}
+
+	if cond&0x1 == 1 {
+		return !passed
+	}
+	return passed
+}
+
+func (pkt CondInstFmt1ETMv4) Key() uint32 {
+	return pkt.key
+}
+
+func (pkt CondInstFmt1ETMv4) String() string {
+	return fmt.Sprintf("Conditional Instruction Format 1: Key: %d", pkt.key)
+}
+
+// CI returns the 2-bit CI field selecting how the key is advanced for the
+// traced conditional instruction(s).
+func (pkt CondInstFmt2ETMv4) CI() uint8 {
+	return pkt.ci
+}
+
+func (pkt CondInstFmt2ETMv4) String() string {
+	return fmt.Sprintf("Conditional Instruction Format 2: CI: %d", pkt.ci)
+}
+
+func (pkt CondInstFmt3ETMv4) Num() uint8 {
+	return pkt.num
+}
+
+func (pkt CondInstFmt3ETMv4) Final() bool {
+	return pkt.final
+}
+
+func (pkt CondInstFmt3ETMv4) String() string {
+	return fmt.Sprintf("Conditional Instruction Format 3: Num: %d Z: %t", pkt.num, pkt.final)
+}
+
+func (pkt CondResultFmt1ETMv4) CI() []bool {
+	return pkt.ci
+}
+
+func (pkt CondResultFmt1ETMv4) Keys() []uint32 {
+	return pkt.key
+}
+
+// Results returns the APSR NZCV flags reported for each key.
+func (pkt CondResultFmt1ETMv4) Results() []uint8 {
+	return pkt.result
+}
+
+func (pkt CondResultFmt1ETMv4) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("Conditional Result Format 1:")
+
+	for i := range pkt.key {
+		buffer.WriteString(fmt.Sprintf(" Key: %d Result: 0x%x CI: %t", pkt.key[i], pkt.result[i], pkt.ci[i]))
+	}
+	return buffer.String()
+}
+
+func (pkt CondResultFmt2ETMv4) KeyIncrement() uint8 {
+	return pkt.key_incr
+}
+
+func (pkt CondResultFmt2ETMv4) Result() uint8 {
+	return pkt.result
+}
+
+func (pkt CondResultFmt2ETMv4) String() string {
+	return fmt.Sprintf("Conditional Result Format 2: Key +%d Result: 0x%x", pkt.key_incr, pkt.result)
+}
+
+// Tokens returns the 12-bit field of packed pass/fail tokens.
+func (pkt CondResultFmt3ETMv4) Tokens() uint16 {
+	return pkt.tokens
+}
+
+func (pkt CondResultFmt3ETMv4) String() string {
+	return fmt.Sprintf("Conditional Result Format 3: Tokens: 0x%03x", pkt.tokens)
+}
+
+func (pkt CondResultFmt4ETMv4) Result() uint8 {
+	return pkt.result
+}
+
+func (pkt CondResultFmt4ETMv4) String() string {
+	return fmt.Sprintf("Conditional Result Format 4: Result: 0x%x", pkt.result)
+}
+
+func (CondFlushETMv4) String() string {
+	return "Conditional Flush"
+}
+
+func (pkt CondInstFmt1ETMv4) Encode() []byte {
+	return append([]byte{0x6c}, encodeContinuation(uint64(pkt.key), 5)...)
+}
+
+func (pkt CondInstFmt2ETMv4) Encode() []byte {
+	if pkt.ci > 2 {
+		return nil
+	}
+	return []byte{0x40 | pkt.ci}
+}
+
+func (pkt CondInstFmt3ETMv4) Encode() []byte {
+	payload := (pkt.num & 0x3f) << 1
+	if pkt.final {
+		payload |= 0x1
+	}
+	return []byte{0x6d, payload}
+}
+
+func (pkt CondResultFmt1ETMv4) Encode() []byte {
+	var header byte
+	switch len(pkt.key) {
+	case 1:
+		header = 0x6e
+	case 2:
+		header = 0x68
+	default:
+		return nil
+	}
+
+	out := []byte{header}
+	for i := range pkt.key {
+		if pkt.ci[i] {
+			out[0] |= 1 << uint(i)
+		}
+
+		key := pkt.key[i]
+		payload := byte(key&0x7)<<4 | pkt.result[i]&0xf
+		if key>>3 == 0 {
+			out = append(out, payload)
+			continue
+		}
+		out = append(out, payload|0x80)
+		out = append(out, encodeContinuation(uint64(key>>3), 4)...)
+	}
+	return out
+}
+
+func (pkt CondResultFmt2ETMv4) Encode() []byte {
+	header := 0x48 | pkt.result&0x3
+	if pkt.key_incr == 2 {
+		header |= 0x4
+	}
+	return []byte{header}
+}
+
+func (pkt CondResultFmt3ETMv4) Encode() []byte {
+	return []byte{0x50 | byte(pkt.tokens>>8)&0xf, byte(pkt.tokens)}
+}
+
+func (pkt CondResultFmt4ETMv4) Encode() []byte {
+	if pkt.result > 2 {
+		return nil
+	}
+	return []byte{0x44 | pkt.result}
+}
+
+func (CondFlushETMv4) Encode() []byte {
+	return []byte{0x43}
+}
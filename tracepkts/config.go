@@ -0,0 +1,233 @@
+package tracepkts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config describes the trace unit that produced a stream, as read from its
+// ID registers (TRCIDR0-TRCIDR13) and programming (TRCCONFIGR, TRCCCCTLR).
+// Registers missing from the Config decode as the most permissive trace unit,
+// which is how the decoders behaved before they took a Config.
+type Config struct {
+	registers map[string]uint32
+	// Address stack depth, not described by any register
+	stack_depth int
+}
+
+// Register names understood by a Config, beyond TRCIDR0-TRCIDR13
+const (
+	TRCCONFIGR  = "TRCCONFIGR"
+	TRCCCCTLR   = "TRCCCCTLR"
+	TRCTRACEIDR = "TRCTRACEIDR"
+	// Not a register, overrides ADDR_COMP_STK_DEPTH
+	ADDR_STACK_DEPTH = "ADDR_STACK_DEPTH"
+)
+
+func DefaultConfig() *Config {
+	return NewConfig(nil)
+}
+
+// NewConfig builds a Config from register values keyed by register name.
+func NewConfig(registers map[string]uint32) *Config {
+	c := &Config{registers: make(map[string]uint32), stack_depth: ADDR_COMP_STK_DEPTH}
+	for name, value := range registers {
+		c.Set(name, value)
+	}
+	return c
+}
+
+// LoadConfig reads a register dump, either a JSON object of register names to
+// values or key=value lines.  Values may be numbers or strings in any base Go
+// accepts, such as "0x28000ea1".
+func LoadConfig(in io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return loadConfigJSON(trimmed)
+	}
+	return loadConfigKeyValue(data)
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadConfig(file)
+}
+
+func loadConfigJSON(data []byte) (*Config, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	c := NewConfig(nil)
+	for name, field := range fields {
+		var value uint64
+		var err error
+
+		switch v := field.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				err = fmt.Errorf("%v is not an integer", v)
+			} else if v < 0 || v > math.MaxUint32 {
+				err = fmt.Errorf("%.0f out of range for a 32-bit register", v)
+			}
+			value = uint64(v)
+		case string:
+			value, err = strconv.ParseUint(v, 0, 32)
+		default:
+			err = fmt.Errorf("unexpected %T", field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %v", name, err)
+		}
+		c.Set(name, uint32(value))
+	}
+	return c, nil
+}
+
+func loadConfigKeyValue(data []byte) (*Config, error) {
+	c := NewConfig(nil)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line_num := 1; scanner.Scan(); line_num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("config: line %d: expected name=value", line_num)
+		}
+
+		name := strings.TrimSpace(kv[0])
+		value, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("config: line %d: %s: %v", line_num, name, err)
+		}
+		c.Set(name, uint32(value))
+	}
+	return c, scanner.Err()
+}
+
+// Set records the value of a register, names are case insensitive.
+func (c *Config) Set(name string, value uint32) {
+	name = strings.ToUpper(name)
+	if name == ADDR_STACK_DEPTH {
+		c.stack_depth = int(value)
+		return
+	}
+	c.registers[name] = value
+}
+
+// Register returns the value of a register, or false when it wasn't given.
+func (c *Config) Register(name string) (uint32, bool) {
+	if c == nil {
+		return 0, false
+	}
+	value, ok := c.registers[strings.ToUpper(name)]
+	return value, ok
+}
+
+// field extracts register bits [lsb+width-1:lsb].
+func (c *Config) field(name string, lsb uint, width uint) (uint32, bool) {
+	value, ok := c.Register(name)
+	return value >> lsb & (1<<width - 1), ok
+}
+
+// VMIDBytes returns the size of the VMID in Context packets, TRCIDR2.VMIDSIZE.
+func (c *Config) VMIDBytes() int {
+	size, ok := c.field("TRCIDR2", 10, 5)
+	if !ok {
+		return 4
+	}
+	return int(size)
+}
+
+// CIDBytes returns the size of the CONTEXTID in Context packets,
+// TRCIDR2.CIDSIZE.
+func (c *Config) CIDBytes() int {
+	size, ok := c.field("TRCIDR2", 5, 5)
+	if !ok {
+		return 4
+	}
+	return int(size)
+}
+
+// CommitField reports whether Cycle Count Format 1 packets carry a commit
+// count, which TRCIDR0.COMMOPT removes.
+func (c *Config) CommitField() bool {
+	commopt, _ := c.field("TRCIDR0", 29, 1)
+	return commopt == 0
+}
+
+// MaxSpecDepth returns TRCIDR8.MAXSPEC, or false when it's unknown.
+func (c *Config) MaxSpecDepth() (uint32, bool) {
+	return c.Register("TRCIDR8")
+}
+
+// QEnabled reports whether Q packets can appear in the trace, needing both
+// TRCIDR0.QSUPP and TRCCONFIGR.QE.
+func (c *Config) QEnabled() bool {
+	if qsupp, ok := c.field("TRCIDR0", 15, 2); ok && qsupp == 0 {
+		return false
+	}
+	if qe, ok := c.field(TRCCONFIGR, 13, 2); ok && qe == 0 {
+		return false
+	}
+	return true
+}
+
+// CondEnabled reports whether conditional instruction trace was programmed,
+// TRCCONFIGR.COND, which requires TRCIDR0.TRCCOND.
+func (c *Config) CondEnabled() bool {
+	if trccond, ok := c.field("TRCIDR0", 6, 1); ok && trccond == 0 {
+		return false
+	}
+	if cond, ok := c.field(TRCCONFIGR, 8, 3); ok && cond == 0 {
+		return false
+	}
+	return true
+}
+
+// ReturnStack reports whether the return stack was enabled, TRCCONFIGR.RS.
+func (c *Config) ReturnStack() bool {
+	rs, _ := c.field(TRCCONFIGR, 12, 1)
+	return rs == 1
+}
+
+// CCThreshold returns the cycle counting threshold, TRCCCCTLR.THRESHOLD, which
+// every cycle count packet is relative to.
+func (c *Config) CCThreshold() uint32 {
+	threshold, _ := c.field(TRCCCCTLR, 0, 12)
+	return threshold
+}
+
+// TraceID returns the trace ID of the trace unit, TRCTRACEIDR.TRACEID.
+func (c *Config) TraceID() (uint32, bool) {
+	return c.field(TRCTRACEIDR, 0, 7)
+}
+
+func (c *Config) AddrStackDepth() int {
+	if c == nil {
+		return ADDR_COMP_STK_DEPTH
+	}
+	return c.stack_depth
+}
@@ -0,0 +1,95 @@
+package tracepkts
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ETMv4Context is the PE context in effect, built up from Context packets.
+// A Context packet without payload, or without the VMID or CONTEXTID, leaves
+// the previous values in place.
+type ETMv4Context struct {
+	valid      bool
+	el         int
+	a64        bool
+	ns         bool
+	vmid_valid bool
+	vmid       uint32
+	cid_valid  bool
+	cid        uint32
+}
+
+// Update applies a Context packet.
+func (c *ETMv4Context) Update(pkt ContextETMv4) {
+	if !pkt.payload_valid {
+		return
+	}
+
+	c.valid = true
+	c.el = pkt.el
+	c.a64 = pkt.a64
+	c.ns = pkt.ns
+
+	if pkt.vmid_valid {
+		c.vmid_valid = true
+		c.vmid = pkt.vmid
+	}
+
+	if pkt.cid_valid {
+		c.cid_valid = true
+		c.cid = pkt.cid
+	}
+}
+
+// Valid is false until a Context packet with payload has been seen.
+func (c ETMv4Context) Valid() bool {
+	return c.valid
+}
+
+func (c ETMv4Context) EL() int {
+	return c.el
+}
+
+func (c ETMv4Context) A64() bool {
+	return c.a64
+}
+
+func (c ETMv4Context) NS() bool {
+	return c.ns
+}
+
+func (c ETMv4Context) VMIDValid() bool {
+	return c.vmid_valid
+}
+
+func (c ETMv4Context) VMID() uint32 {
+	return c.vmid
+}
+
+func (c ETMv4Context) ContextIDValid() bool {
+	return c.cid_valid
+}
+
+func (c ETMv4Context) ContextID() uint32 {
+	return c.cid
+}
+
+func (c ETMv4Context) String() string {
+	if !c.valid {
+		return "EL: unknown"
+	}
+
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("EL: %d A64: %t NS: %t", c.el, c.a64, c.ns))
+
+	if c.vmid_valid {
+		buffer.WriteString(fmt.Sprintf(" VMID: %x", c.vmid))
+	}
+
+	if c.cid_valid {
+		buffer.WriteString(fmt.Sprintf(" CID: %x", c.cid))
+	}
+
+	return buffer.String()
+}
@@ -1,9 +1,7 @@
 package tracepkts
 
 import (
-	"bufio"
 	"fmt"
-	"log"
 )
 
 type CycleCountFmt1ETMv4 struct {
@@ -11,11 +9,16 @@ type CycleCountFmt1ETMv4 struct {
 	cycle_count_unknown bool
 	cycle_count         uint32
 	commit              uint32
+	no_commit           bool
+	// Cycle counting threshold, added to the COUNT field
+	threshold uint32
 }
 
 type CycleCountFmt2ETMv4 struct {
 	*GenericTracePacketv4
 	*CycleCountFmt1ETMv4
+	spec_relative bool
+	a             uint8
 }
 
 type CycleCountFmt3ETMv4 struct {
@@ -23,19 +26,21 @@ type CycleCountFmt3ETMv4 struct {
 	*CycleCountFmt1ETMv4
 }
 
-func DecodeCycleCountFmt1(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CycleCountFmt1ETMv4{}
+func DecodeCycleCountFmt1(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CycleCountFmt1ETMv4{GenericTracePacketv4: reader.generic()}
 
 	if header&0x1 == 1 {
 		pkt.cycle_count_unknown = true
 	}
 
-	for i := 0; ; i++ {
+	// TRCIDR0.COMMOPT drops the commit section
+	pkt.no_commit = !reader.Config().CommitField()
+
+	for i := 0; !pkt.no_commit; i++ {
 		commit_byte, err := reader.ReadByte()
 
 		if err != nil {
-			log.Printf("Error reading bytes for Cycle Count on COMMIT bytes.")
-			return nil
+			return nil, truncated(reader, header, "Cycle Count Format 1", err)
 		}
 
 		pkt.commit |= uint32(commit_byte&0x7f) << uint(7*i)
@@ -51,15 +56,14 @@ func DecodeCycleCountFmt1(header byte, reader *bufio.Reader) TracePacket {
 
 	// Bail early if it's unknown
 	if pkt.cycle_count_unknown {
-		return pkt
+		return pkt, nil
 	}
 
 	for ; i < 2; i++ {
 		count_byte, err = reader.ReadByte()
 
 		if err != nil {
-			log.Printf("Error reading bytes for Cycle Count on COUNT bytes.")
-			return nil
+			return nil, truncated(reader, header, "Cycle Count Format 1", err)
 		}
 
 		pkt.cycle_count |= uint32(count_byte&0x7f) << uint(7*i)
@@ -74,44 +78,66 @@ func DecodeCycleCountFmt1(header byte, reader *bufio.Reader) TracePacket {
 		count_byte, err = reader.ReadByte()
 
 		if err != nil {
-			log.Printf("Error reading bytes for Cycle Count on last COUNT byte.")
-			return nil
+			return nil, truncated(reader, header, "Cycle Count Format 1", err)
 		}
 
 		pkt.cycle_count |= uint32(count_byte&0x3f) << 14
 	}
 
-	return pkt
+	pkt.threshold = reader.CCThreshold()
+	pkt.cycle_count += pkt.threshold
+	return pkt, nil
 }
 
-func DecodeCycleCountFmt2(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CycleCountFmt2ETMv4{}
+func DecodeCycleCountFmt2(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CycleCountFmt2ETMv4{GenericTracePacketv4: reader.generic(), CycleCountFmt1ETMv4: &CycleCountFmt1ETMv4{}}
 
 	f := header & 0x1
 
 	payload, err := reader.ReadByte()
 
 	if err != nil {
-		log.Printf("Error parsing payload byte for Cycle Count.")
-		return nil
+		return nil, truncated(reader, header, "Cycle Count Format 2", err)
 	}
 
-	pkt.cycle_count = uint32(payload & 0x0f)
+	pkt.threshold = reader.CCThreshold()
+	pkt.cycle_count = uint32(payload&0x0f) + pkt.threshold
+	pkt.a = uint8(payload >> 4)
 	// AAAA field is either AAAA+1 (F=0) or max_spec_depth+AAAA-15 (F=1)
 	if f == 0 {
-		pkt.commit = uint32(payload&0xf0>>4) + 1
+		pkt.commit = uint32(pkt.a) + 1
+	} else {
+		pkt.spec_relative = true
+		if max_spec, ok := reader.Config().MaxSpecDepth(); ok {
+			pkt.commit = max_spec + uint32(pkt.a) - 15
+		}
 	}
 
-	return pkt
+	return pkt, nil
 }
 
-func DecodeCycleCountFmt3(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CycleCountFmt3ETMv4{}
+func DecodeCycleCountFmt3(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CycleCountFmt3ETMv4{GenericTracePacketv4: reader.generic(), CycleCountFmt1ETMv4: &CycleCountFmt1ETMv4{}}
 
-	pkt.cycle_count = uint32(header & 0x3)
+	pkt.threshold = reader.CCThreshold()
+	pkt.cycle_count = uint32(header&0x3) + pkt.threshold
 	pkt.commit = uint32(header&0x0c) >> 2
 
-	return pkt
+	return pkt, nil
+}
+
+func (pkt CycleCountFmt1ETMv4) CycleCountUnknown() bool {
+	return pkt.cycle_count_unknown
+}
+
+// CycleCount returns the cycles counted, the COUNT field plus the threshold
+// of the last Trace Info or the Config.
+func (pkt CycleCountFmt1ETMv4) CycleCount() uint32 {
+	return pkt.cycle_count
+}
+
+func (pkt CycleCountFmt1ETMv4) Commit() uint32 {
+	return pkt.commit
 }
 
 func (pkt CycleCountFmt1ETMv4) String() string {
@@ -121,3 +147,48 @@ func (pkt CycleCountFmt1ETMv4) String() string {
 		return fmt.Sprintf("Cycle Count Format 1: Commit: %0d Cycle Count: %0d", pkt.commit, pkt.cycle_count)
 	}
 }
+
+// SpecRelative reports a commit count relative to the maximum speculation
+// depth.  Commit() resolves it when the Config gives TRCIDR8.MAXSPEC, and
+// leaves it as 0 otherwise.
+func (pkt CycleCountFmt2ETMv4) SpecRelative() bool {
+	return pkt.spec_relative
+}
+
+// A returns the AAAA field the commit count is derived from.
+func (pkt CycleCountFmt2ETMv4) A() uint8 {
+	return pkt.a
+}
+
+func (pkt CycleCountFmt2ETMv4) String() string {
+	return fmt.Sprintf("Cycle Count Format 2: Commit: %0d Cycle Count: %0d", pkt.commit, pkt.cycle_count)
+}
+
+func (pkt CycleCountFmt3ETMv4) String() string {
+	return fmt.Sprintf("Cycle Count Format 3: Commit: %0d Cycle Count: %0d", pkt.commit, pkt.cycle_count)
+}
+
+func (pkt CycleCountFmt1ETMv4) Encode() []byte {
+	out := []byte{0x0e}
+	if pkt.cycle_count_unknown {
+		out[0] = 0x0f
+	}
+	if !pkt.no_commit {
+		out = append(out, encodeContinuation(uint64(pkt.commit), 5)...)
+	}
+	if pkt.cycle_count_unknown {
+		return out
+	}
+	return append(out, encodeContinuation(uint64(pkt.cycle_count-pkt.threshold), 2)...)
+}
+
+func (pkt CycleCountFmt2ETMv4) Encode() []byte {
+	if pkt.spec_relative {
+		return []byte{0x0d, pkt.a<<4 | byte((pkt.cycle_count-pkt.threshold)&0xf)}
+	}
+	return []byte{0x0c, byte(pkt.commit-1)<<4 | byte((pkt.cycle_count-pkt.threshold)&0xf)}
+}
+
+func (pkt CycleCountFmt3ETMv4) Encode() []byte {
+	return []byte{0x10 | byte(pkt.commit&0x3)<<2 | byte((pkt.cycle_count-pkt.threshold)&0x3)}
+}
@@ -0,0 +1,217 @@
+package tracepkts
+
+import (
+	"fmt"
+)
+
+// Data trace (P1/P2 elements) is carried in a separate stream from the
+// instruction trace.  The instruction stream only marks where data elements
+// belong with Data Synchronization markers.
+//
+// Data stream header encodings:
+//   0xb0-0xb2 P1 data address, exact match against data address stack entry
+//   0xb4      P1 data address, short (7 or 15 bits)
+//   0xb6      P1 data address, long 32-bit
+//   0xb8      P1 data address, long 64-bit
+//   0xc0-0xcf P2 data value, bits[1:0] size (1 << SS bytes), bit[2] store
+//
+// All other headers (Async, Overflow, Trace Info, Timestamp...) are shared with
+// the instruction stream.
+
+const (
+	DATA_ACCESS_BYTE = iota
+	DATA_ACCESS_HALFWORD
+	DATA_ACCESS_WORD
+	DATA_ACCESS_DOUBLEWORD
+)
+
+type NumDataSyncETMv4 struct {
+	*GenericTracePacketv4
+	num uint8
+}
+
+type UnnumDataSyncETMv4 struct {
+	*GenericTracePacketv4
+	a uint8
+}
+
+type DataAddrETMv4 struct {
+	*GenericTracePacketv4
+	offset uint64
+	width  uint8
+}
+
+type DataExactAddrETMv4 struct {
+	*GenericTracePacketv4
+	entry uint8
+}
+
+type DataValueETMv4 struct {
+	*GenericTracePacketv4
+	size  uint8
+	store bool
+	value uint64
+}
+
+func DecodeNumDataSync(header byte, reader *Reader) (TracePacket, error) {
+	return NumDataSyncETMv4{GenericTracePacketv4: reader.generic(), num: uint8(header & 0x7)}, nil
+}
+
+func DecodeUnnumDataSync(header byte, reader *Reader) (TracePacket, error) {
+	return UnnumDataSyncETMv4{GenericTracePacketv4: reader.generic(), a: uint8(header & 0x7)}, nil
+}
+
+// DecodeDataPacket decodes a single packet from a data trace stream.
+func DecodeDataPacket(header byte, reader *Reader) (TracePacket, error) {
+	switch {
+	case header >= 0xb0 && header <= 0xb2:
+		return DataExactAddrETMv4{GenericTracePacketv4: reader.generic(), entry: uint8(header & 0x3)}, nil
+	case header == 0xb4:
+		return decodeDataAddr(header, reader, 2)
+	case header == 0xb6:
+		return decodeDataAddr(header, reader, 4)
+	case header == 0xb8:
+		return decodeDataAddr(header, reader, 8)
+	case header >= 0xc0 && header <= 0xcf:
+		return DecodeDataValue(header, reader)
+	}
+	return DecodePacket(header, reader)
+}
+
+// decodeDataAddr reads a data address of addr_bytes bytes with the
+// instruction address readers.  Data addresses are byte aligned, so unlike
+// instruction addresses no low bits are implied, and long addresses use every
+// bit of the payload.
+func decodeDataAddr(header byte, reader *Reader, addr_bytes int) (TracePacket, error) {
+	pkt := DataAddrETMv4{GenericTracePacketv4: reader.generic(), width: uint8(8 * addr_bytes)}
+
+	var err error
+	if addr_bytes == 2 {
+		pkt.offset, pkt.width, err = readShortAddr(header, reader, "Data Address", 0)
+	} else {
+		pkt.offset, err = readAddrBytes(header, reader, "Data Address", 0, 0, addr_bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func DecodeDataValue(header byte, reader *Reader) (TracePacket, error) {
+	pkt := DataValueETMv4{GenericTracePacketv4: reader.generic(), size: uint8(header & 0x3)}
+
+	if header&0x4 == 0x4 {
+		pkt.store = true
+	}
+
+	for i := 0; i < 1<<pkt.size; i++ {
+		value_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Data Value", err)
+		}
+		pkt.value |= uint64(value_byte) << uint(8*i)
+	}
+	return pkt, nil
+}
+
+func (pkt NumDataSyncETMv4) Num() uint8 {
+	return pkt.num
+}
+
+func (pkt NumDataSyncETMv4) String() string {
+	return fmt.Sprintf("Data Sync Marker: %d", pkt.num)
+}
+
+// A returns the unnumbered marker type; 0b100 marks the end of a data
+// transfer that spans multiple instructions.
+func (pkt UnnumDataSyncETMv4) A() uint8 {
+	return pkt.a
+}
+
+func (pkt UnnumDataSyncETMv4) String() string {
+	return fmt.Sprintf("Data Sync Marker (Unnumbered): A: %d", pkt.a)
+}
+
+func (pkt DataAddrETMv4) AddrWithBase(base uint64) uint64 {
+	return addrWithBase(base, pkt.offset, pkt.width)
+}
+
+// PartialAddress returns the address bits carried by the packet, before
+// they're combined with the address stack.
+func (pkt DataAddrETMv4) PartialAddress() uint64 {
+	return pkt.offset
+}
+
+func (pkt DataAddrETMv4) Width() uint8 {
+	return pkt.width
+}
+
+func (pkt DataAddrETMv4) String() string {
+	return fmt.Sprintf("Data Offset = 0x%x (%d-bit)", pkt.offset, pkt.width)
+}
+
+func (pkt DataExactAddrETMv4) Entry() uint8 {
+	return pkt.entry
+}
+
+func (pkt DataExactAddrETMv4) String() string {
+	return fmt.Sprintf("data_address_reg[%d] match=true", pkt.entry)
+}
+
+// Size returns the access size as one of the DATA_ACCESS_* constants.
+func (pkt DataValueETMv4) Size() uint8 {
+	return pkt.size
+}
+
+func (pkt DataValueETMv4) Store() bool {
+	return pkt.store
+}
+
+func (pkt DataValueETMv4) Value() uint64 {
+	return pkt.value
+}
+
+func (pkt DataValueETMv4) String() string {
+	access := "Load"
+	if pkt.store {
+		access = "Store"
+	}
+	return fmt.Sprintf("Data Value: %s 0x%0*x (%d-byte)", access, 2<<pkt.size, pkt.value, 1<<pkt.size)
+}
+
+func (pkt NumDataSyncETMv4) Encode() []byte {
+	return []byte{0x20 | pkt.num&0x7}
+}
+
+func (pkt UnnumDataSyncETMv4) Encode() []byte {
+	if pkt.a > 4 {
+		return nil
+	}
+	return []byte{0x28 | pkt.a}
+}
+
+func (pkt DataAddrETMv4) Encode() []byte {
+	switch pkt.width {
+	case 7:
+		return []byte{0xb4, byte(pkt.offset & 0x7f)}
+	case 15:
+		return []byte{0xb4, byte(pkt.offset&0x7f) | 0x80, byte(pkt.offset >> 7)}
+	case 32:
+		return append([]byte{0xb6}, littleEndian(pkt.offset, 4)...)
+	case 64:
+		return append([]byte{0xb8}, littleEndian(pkt.offset, 8)...)
+	}
+	return nil
+}
+
+func (pkt DataExactAddrETMv4) Encode() []byte {
+	return []byte{0xb0 | pkt.entry&0x3}
+}
+
+func (pkt DataValueETMv4) Encode() []byte {
+	header := 0xc0 | pkt.size&0x3
+	if pkt.store {
+		header |= 0x4
+	}
+	return append([]byte{header}, littleEndian(pkt.value, 1<<(pkt.size&0x3))...)
+}
@@ -0,0 +1,281 @@
+package tracepkts
+
+import (
+	"fmt"
+	"io"
+)
+
+// An ETMv4 Async is eleven 0x00 bytes followed by 0x80
+const (
+	ASYNC_ZEROS = 11
+)
+
+// Options configures a Decoder.
+type Options struct {
+	// Protocol selects the ETMv4 or ETE packet set.
+	Protocol Protocol
+	// Data decodes an ETMv4 data trace stream rather than instruction trace.
+	Data bool
+	// NoSync decodes from the first byte instead of skipping to the first
+	// Async, for captures that may not contain one.
+	NoSync bool
+	// AsyncZeros is the number of 0x00 bytes leading the Async of the
+	// protocol, ASYNC_ZEROS when left at 0.
+	AsyncZeros int
+	// Resync skips to the next Async after a bad packet, returning a Gap
+	// covering the skipped bytes instead of the error.
+	Resync bool
+	// Config describes the trace unit, DefaultConfig when nil.
+	Config *Config
+	// PacketFunc replaces the ETMv4 packet decoders, so protocols sharing
+	// the Async scheme such as PTM and ETMv3 can use the Decoder.
+	PacketFunc func(header byte, reader *Reader) (TracePacket, error)
+}
+
+// Decoder reads packets one at a time from a trace stream.  The input is
+// only ever read forwards, so pipes and sockets work as well as files.
+type Decoder struct {
+	reader *Reader
+	opts   Options
+	synced bool
+	stack  ETMv4AddressStack
+	// Data addresses are compressed against their own history
+	data_stack ETMv4AddressStack
+
+	// Timestamp Timestamp packets are compressed against
+	timestamp uint64
+	ts_valid  bool
+
+	context ETMv4Context
+}
+
+// Gap reports a range of the stream skipped while resynchronizing.
+type Gap struct {
+	*GenericTracePacketv4
+	start int64
+	end   int64
+	cause error
+}
+
+func NewDecoder(in io.Reader, opts Options) *Decoder {
+	if opts.AsyncZeros == 0 {
+		opts.AsyncZeros = ASYNC_ZEROS
+	}
+	d := &Decoder{reader: NewReader(in), opts: opts, synced: opts.NoSync}
+	d.reader.SetConfig(opts.Config)
+	d.resetStack()
+	return d
+}
+
+// Next returns the next packet in the stream, or io.EOF once it's exhausted.
+// Errors for a single packet, such as a TruncatedPacketError, leave the
+// Decoder ready to carry on with the following packet.
+func (d *Decoder) Next() (TracePacket, error) {
+	if !d.synced {
+		if err := d.sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := d.reader.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	pkt, err := d.decode(header)
+	if err == nil {
+		err = d.checkExact(header, pkt)
+	}
+	if err != nil {
+		if d.opts.Resync && IsPacketError(err) {
+			return d.resync(err)
+		}
+		return nil, err
+	}
+
+	d.annotate(pkt)
+
+	switch addr_pkt := pkt.(type) {
+	case QETMv4:
+		if addr_pkt.Address() != nil {
+			d.stack.Update(addr_pkt.Address())
+		}
+	case SourceAddrETE:
+		d.stack.Update(addr_pkt.Address())
+	case DataAddrETMv4, DataExactAddrETMv4:
+		d.data_stack.Update(pkt)
+	default:
+		d.stack.Update(pkt)
+	}
+	return pkt, nil
+}
+
+func (d *Decoder) decode(header byte) (TracePacket, error) {
+	switch {
+	case d.opts.PacketFunc != nil:
+		return d.opts.PacketFunc(header, d.reader)
+	case d.opts.Data:
+		return DecodeDataPacket(header, d.reader)
+	}
+	return DecodeProtocolPacket(d.opts.Protocol, header, d.reader)
+}
+
+// checkExact fails exact match address packets naming an address stack entry
+// that hasn't been filled, as at the start of a trace or after a gap.
+func (d *Decoder) checkExact(header byte, pkt TracePacket) error {
+	var stack *ETMv4AddressStack
+	var entry uint8
+
+	switch addr_pkt := pkt.(type) {
+	case QETMv4:
+		return d.checkExact(header, addr_pkt.Address())
+	case SourceAddrETE:
+		return d.checkExact(header, addr_pkt.Address())
+	case ExactAddrETMv4:
+		stack, entry = &d.stack, addr_pkt.Entry()
+	case DataExactAddrETMv4:
+		stack, entry = &d.data_stack, addr_pkt.Entry()
+	default:
+		return nil
+	}
+
+	if int(entry) >= stack.Len() {
+		return malformed(d.reader, header, "Exact Match Address", fmt.Sprintf("address stack entry %d is empty", entry))
+	}
+	return nil
+}
+
+// sync skips to the first Async, AsyncZeros 0x00 bytes followed by 0x80, and
+// puts the Async back in front of the stream so it's decoded as a packet.
+func (d *Decoder) sync() error {
+	zeros := 0
+	for {
+		b, err := d.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == 0x00 {
+			zeros++
+		} else if b == 0x80 && zeros >= d.opts.AsyncZeros {
+			break
+		} else {
+			zeros = 0
+		}
+	}
+
+	d.reader.unread(append(make([]byte, d.opts.AsyncZeros), 0x80))
+	d.synced = true
+	return nil
+}
+
+// resync searches for an Async from the byte after the header of the packet
+// that failed with cause, and describes the bytes passed over as a Gap.
+func (d *Decoder) resync(cause error) (TracePacket, error) {
+	start := d.reader.PacketOffset()
+	failed := d.reader.PacketBytes()
+	d.reader.unread(failed[1:])
+
+	// The bytes scanned for the Async are collected as the Gap rather than
+	// as part of the failed packet
+	generic := &GenericTracePacketv4{header: failed[0], raw: []byte{failed[0]}, offset: start}
+	d.reader.current = generic
+
+	err := d.sync()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Address history from before the gap can't be trusted
+	d.resetStack()
+	d.timestamp, d.ts_valid = 0, false
+	d.context = ETMv4Context{}
+	d.reader.setCCThreshold(0, false)
+
+	end := d.reader.Offset()
+	generic.raw = generic.raw[:end-start]
+	return Gap{GenericTracePacketv4: generic, start: start, end: end, cause: cause}, nil
+}
+
+func (d *Decoder) resetStack() {
+	d.stack = ETMv4AddressStack{}
+	d.stack.SetDepth(d.opts.Config.AddrStackDepth())
+	d.data_stack = ETMv4AddressStack{}
+	d.data_stack.SetDepth(d.opts.Config.AddrStackDepth())
+}
+
+// annotate tracks the timestamp and context through the stream and attaches
+// them to the packet.  Timestamp packets are merged into the running
+// timestamp, which Async and Trace Info restart from zero.  Trace Info also
+// leaves the context unknown until the next Context packet, and sets the
+// cycle counting threshold when it carries one.
+func (d *Decoder) annotate(pkt TracePacket) {
+	switch state_pkt := pkt.(type) {
+	case AsyncETMv4:
+		d.timestamp, d.ts_valid = 0, false
+		d.context = ETMv4Context{}
+	case TraceInfoETMv4:
+		d.timestamp, d.ts_valid = 0, false
+		d.context = ETMv4Context{}
+		d.reader.setCCThreshold(state_pkt.cc_threshold, state_pkt.plctl&0x8 == 0x8)
+	case TimestampETMv4:
+		d.timestamp, d.ts_valid = state_pkt.Merge(d.timestamp), true
+	case ContextETMv4:
+		d.context.Update(state_pkt)
+	}
+
+	generic := d.reader.generic()
+	generic.timestamp, generic.ts_valid = d.timestamp, d.ts_valid
+	generic.context = d.context
+}
+
+// Timestamp returns the full timestamp reconstructed so far.
+func (d *Decoder) Timestamp() (uint64, bool) {
+	return d.timestamp, d.ts_valid
+}
+
+// Context returns the PE context in effect.
+func (d *Decoder) Context() ETMv4Context {
+	return d.context
+}
+
+// AddressStack returns the addresses the Decoder has resolved so far, most
+// recent first.
+func (d *Decoder) AddressStack() *ETMv4AddressStack {
+	return &d.stack
+}
+
+// DataAddressStack returns the data addresses the Decoder has resolved so
+// far, most recent first.
+func (d *Decoder) DataAddressStack() *ETMv4AddressStack {
+	return &d.data_stack
+}
+
+// PacketOffset returns the stream offset of the last packet read.
+func (d *Decoder) PacketOffset() int64 {
+	return d.reader.PacketOffset()
+}
+
+// PacketBytes returns the raw bytes of the last packet read.
+func (d *Decoder) PacketBytes() []byte {
+	return d.reader.PacketBytes()
+}
+
+// Start returns the offset of the first skipped byte.
+func (g Gap) Start() int64 {
+	return g.start
+}
+
+// End returns the offset following the last skipped byte.
+func (g Gap) End() int64 {
+	return g.end
+}
+
+// Cause returns the decode error that forced the resynchronization.
+func (g Gap) Cause() error {
+	return g.cause
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("Gap: 0x%x-0x%x (%d bytes skipped): %v", g.start, g.end, g.end-g.start, g.cause)
+}
@@ -0,0 +1,256 @@
+package tracepkts
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// An ETMv4 Async followed by a Trace On
+var asyncTraceOn = append(append(make([]byte, ASYNC_ZEROS), 0x80), 0x04)
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// expectPacket reads the next packet, checking its type and offset.
+func expectPacket(t *testing.T, decoder *Decoder, want string, offset int64) TracePacket {
+	t.Helper()
+	pkt, err := decoder.Next()
+	if err != nil {
+		t.Fatalf("expected %s at %d: %v", want, offset, err)
+	}
+	var got string
+	switch pkt.(type) {
+	case AsyncETMv4:
+		got = "Async"
+	case TraceOnETMv4:
+		got = "Trace On"
+	case Gap:
+		got = "Gap"
+	default:
+		got = pkt.String()
+	}
+	if got != want || decoder.PacketOffset() != offset {
+		t.Fatalf("decoded %s at %d, want %s at %d", got, decoder.PacketOffset(), want, offset)
+	}
+	return pkt
+}
+
+func expectEOF(t *testing.T, decoder *Decoder) {
+	t.Helper()
+	if pkt, err := decoder.Next(); err != io.EOF {
+		t.Fatalf("decoded %v, %v at the end of the stream", pkt, err)
+	}
+}
+
+func TestDecoderSync(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix []byte
+	}{
+		{"aligned", nil},
+		{"address payload", []byte{0x12, 0x34, 0x56, 0x78}},
+		{"short zero run", []byte{0x9d, 0x00, 0x00, 0x00, 0x80, 0x66}},
+		{"long zero run", make([]byte, 2*ASYNC_ZEROS)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := concat(test.prefix, asyncTraceOn)
+			decoder := NewDecoder(bytes.NewReader(data), Options{})
+
+			start := int64(len(test.prefix))
+			expectPacket(t, decoder, "Async", start)
+			expectPacket(t, decoder, "Trace On", start+ASYNC_ZEROS+1)
+			expectEOF(t, decoder)
+		})
+	}
+}
+
+func TestDecoderNoAsync(t *testing.T) {
+	decoder := NewDecoder(bytes.NewReader([]byte{0x12, 0x00, 0x00, 0x80, 0x04}), Options{})
+	expectEOF(t, decoder)
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"Long Address", []byte{0x9d, 0x11, 0x22}},
+		{"Timestamp", []byte{0x02, 0x81, 0x82}},
+		{"Context", []byte{0x81}},
+		{"Async", []byte{0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := concat(asyncTraceOn, test.packet)
+			decoder := NewDecoder(bytes.NewReader(data), Options{})
+
+			expectPacket(t, decoder, "Async", 0)
+			expectPacket(t, decoder, "Trace On", ASYNC_ZEROS+1)
+
+			_, err := decoder.Next()
+			var truncated *TruncatedPacketError
+			if !errors.As(err, &truncated) {
+				t.Fatalf("got %v, want a truncated packet", err)
+			}
+			if truncated.Offset != int64(len(asyncTraceOn)) || truncated.Header != test.packet[0] {
+				t.Errorf("truncated packet at %d header 0x%02x, want %d header 0x%02x", truncated.Offset, truncated.Header, len(asyncTraceOn), test.packet[0])
+			}
+			expectEOF(t, decoder)
+		})
+	}
+}
+
+func TestDecoderResyncGap(t *testing.T) {
+	tests := []struct {
+		name  string
+		bad   []byte
+		after []byte
+	}{
+		{"reserved header", []byte{0x0a, 0x12, 0x34}, asyncTraceOn},
+		{"reserved header at the end", []byte{0x0a, 0x12, 0x34}, nil},
+		{"bad Extension", []byte{0x00, 0x07, 0x00}, asyncTraceOn},
+		{"malformed Async", []byte{0x00, 0x00, 0x00, 0x05}, asyncTraceOn},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := concat(asyncTraceOn, test.bad, test.after)
+			decoder := NewDecoder(bytes.NewReader(data), Options{Resync: true})
+
+			expectPacket(t, decoder, "Async", 0)
+			expectPacket(t, decoder, "Trace On", ASYNC_ZEROS+1)
+
+			start := int64(len(asyncTraceOn))
+			end := start + int64(len(test.bad))
+			gap := expectPacket(t, decoder, "Gap", start).(Gap)
+			if gap.Start() != start || gap.End() != end {
+				t.Errorf("gap 0x%x-0x%x, want 0x%x-0x%x", gap.Start(), gap.End(), start, end)
+			}
+			if !bytes.Equal(gap.Raw(), test.bad) || !bytes.Equal(decoder.PacketBytes(), test.bad) {
+				t.Errorf("gap bytes % x, packet bytes % x, want % x", gap.Raw(), decoder.PacketBytes(), test.bad)
+			}
+			if !IsPacketError(gap.Cause()) {
+				t.Errorf("gap caused by %v, want a packet error", gap.Cause())
+			}
+
+			if test.after != nil {
+				expectPacket(t, decoder, "Async", end)
+				expectPacket(t, decoder, "Trace On", end+ASYNC_ZEROS+1)
+			}
+			expectEOF(t, decoder)
+		})
+	}
+}
+
+func TestDecoderResyncReset(t *testing.T) {
+	data := concat(
+		asyncTraceOn,
+		[]byte{0x9d, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00}, // Long Address
+		[]byte{0x02, 0x7f},                         // Timestamp
+		[]byte{0x81, 0x51, 0x07, 0x00, 0x00, 0x00}, // Context, VMID 7
+		[]byte{0x0a},                               // reserved
+		asyncTraceOn,
+	)
+	decoder := NewDecoder(bytes.NewReader(data), Options{Resync: true})
+
+	for i := 0; i < 5; i++ {
+		if _, err := decoder.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if decoder.AddressStack().Len() == 0 {
+		t.Fatal("no address before the gap")
+	}
+	if ts, ok := decoder.Timestamp(); !ok || ts != 0x7f {
+		t.Fatalf("timestamp 0x%x %t before the gap", ts, ok)
+	}
+	if ctxt := decoder.Context(); !ctxt.Valid() || ctxt.VMID() != 7 {
+		t.Fatalf("context %s before the gap", ctxt)
+	}
+
+	expectPacket(t, decoder, "Gap", int64(len(data)-len(asyncTraceOn)-1))
+	if n := decoder.AddressStack().Len(); n != 0 {
+		t.Errorf("%d addresses kept across the gap", n)
+	}
+	if ts, ok := decoder.Timestamp(); ok {
+		t.Errorf("timestamp 0x%x kept across the gap", ts)
+	}
+	if ctxt := decoder.Context(); ctxt.Valid() {
+		t.Errorf("context %s kept across the gap", ctxt)
+	}
+}
+
+func TestDecoderCCThreshold(t *testing.T) {
+	config := NewConfig(map[string]uint32{TRCCCCTLR: 0x100})
+	data := concat(
+		asyncTraceOn,
+		[]byte{0x11},             // Cycle Count Format 3, COUNT 1
+		[]byte{0x01, 0x08, 0x20}, // Trace Info, CYCT 0x20
+		[]byte{0x11},
+		[]byte{0x01, 0x00}, // Trace Info without CYCT
+		[]byte{0x11},
+	)
+	decoder := NewDecoder(bytes.NewReader(data), Options{Config: config})
+
+	for _, want := range []uint32{0x101, 0x21, 0x101} {
+		var pkt TracePacket
+		for {
+			var err error
+			if pkt, err = decoder.Next(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := pkt.(CycleCountFmt3ETMv4); ok {
+				break
+			}
+		}
+		if count := pkt.(CycleCountFmt3ETMv4).CycleCount(); count != want {
+			t.Errorf("cycle count 0x%x at %d, want 0x%x", count, decoder.PacketOffset(), want)
+		}
+	}
+}
+
+func TestDecoderExactMissingEntry(t *testing.T) {
+	async := asyncTraceOn[:ASYNC_ZEROS+1]
+	tests := []struct {
+		name   string
+		opts   Options
+		lead   []byte
+		packet []byte
+	}{
+		{"Exact Match Address", Options{}, asyncTraceOn, []byte{0x90}},
+		{"Q with Exact Match Address", Options{}, asyncTraceOn, []byte{0xa1, 0x05}},
+		{"Data Exact Match Address", Options{Data: true}, async, []byte{0xb1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := concat(test.lead, test.packet)
+			decoder := NewDecoder(bytes.NewReader(data), test.opts)
+
+			expectPacket(t, decoder, "Async", 0)
+			if len(test.lead) > len(async) {
+				expectPacket(t, decoder, "Trace On", ASYNC_ZEROS+1)
+			}
+
+			_, err := decoder.Next()
+			var malformed *MalformedPacketError
+			if !errors.As(err, &malformed) {
+				t.Fatalf("got %v, want a malformed packet", err)
+			}
+			if malformed.Offset != int64(len(test.lead)) || malformed.Header != test.packet[0] {
+				t.Errorf("malformed packet at %d header 0x%02x, want %d header 0x%02x", malformed.Offset, malformed.Header, len(test.lead), test.packet[0])
+			}
+			expectEOF(t, decoder)
+		})
+	}
+}
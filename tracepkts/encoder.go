@@ -0,0 +1,175 @@
+package tracepkts
+
+import (
+	"fmt"
+)
+
+// EncodablePacket is a TracePacket that can be serialized back to the bytes
+// of its trace protocol.
+type EncodablePacket interface {
+	TracePacket
+	Encode() []byte
+}
+
+// Highest Atom Format 6 count, 0x14 for 23 atoms.  Headers 0xd5-0xd7 and 0xf5
+// above it are Atom Format 5.
+const (
+	ATOM_FMT6_MAX_COUNT = 20
+)
+
+// Encode serializes a sequence of packets into a trace stream.
+func Encode(packets []TracePacket) ([]byte, error) {
+	var out []byte
+	for _, pkt := range packets {
+		enc_pkt, ok := pkt.(EncodablePacket)
+		if !ok {
+			return nil, fmt.Errorf("packet %T can't be encoded", pkt)
+		}
+		b := enc_pkt.Encode()
+		if b == nil {
+			return nil, fmt.Errorf("packet %q has no valid encoding", pkt.String())
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// CompressAddress returns the smallest address packet that resolves to
+// address against stack, and pushes address just as decoding the packet
+// would.
+func CompressAddress(stack *ETMv4AddressStack, address uint64, is uint8) TracePacket {
+	var pkt TracePacket
+
+	for i := 0; i < stack.Len() && i < ADDR_COMP_STK_DEPTH; i++ {
+		elm := stack.Get(uint8(i))
+		if elm.address == address && elm.is == is {
+			exact_pkt := ExactAddrETMv4{}
+			exact_pkt.exact_match[i] = true
+			pkt = exact_pkt
+			break
+		}
+	}
+
+	if pkt == nil && stack.Len() > 0 {
+		base := stack.Get(0).address
+		for _, width := range []uint8{9 - is, 17 - is, 32} {
+			if address>>width == base>>width {
+				pkt = CompressedAddrETMv4{is: is, offset: address & (1<<width - 1), width: width}
+				break
+			}
+		}
+	}
+
+	if pkt == nil {
+		pkt = Long64bAddrETMv4{is: is, address: address, width: 64}
+	}
+
+	stack.Update(pkt)
+	return pkt
+}
+
+// EncodeAtoms packs atoms, oldest first, into as few atom packets as the
+// available formats allow.
+func EncodeAtoms(atoms []bool) []TracePacket {
+	var packets []TracePacket
+
+	for len(atoms) > 0 {
+		pkt := nextAtomPacket(atoms)
+		packets = append(packets, pkt)
+		atoms = atoms[len(pkt.taken):]
+	}
+	return packets
+}
+
+// nextAtomPacket picks the format covering the most leading atoms.
+func nextAtomPacket(atoms []bool) AtomFmtETMv4 {
+	run := 0
+	for run < len(atoms) && atoms[run] == ATOM_E {
+		run++
+	}
+
+	// Atom Format 6 is a run of E atoms and a final atom of either kind
+	max_run := ATOM_FMT6_MAX_COUNT + 2
+	if run >= 2 && run < len(atoms) && run <= max_run {
+		return AtomFmtETMv4{format_num: 6, taken: copyAtoms(atoms[:run+1])}
+	}
+	if run >= 3 {
+		if run > max_run+1 {
+			run = max_run + 1
+		}
+		return AtomFmtETMv4{format_num: 6, taken: copyAtoms(atoms[:run])}
+	}
+
+	for _, pattern := range atomFmt5Patterns {
+		if atomsHavePrefix(atoms, pattern) {
+			return AtomFmtETMv4{format_num: 5, taken: copyAtoms(pattern)}
+		}
+	}
+	for _, pattern := range atomFmt4Patterns {
+		if atomsHavePrefix(atoms, pattern) {
+			return AtomFmtETMv4{format_num: 4, taken: copyAtoms(pattern)}
+		}
+	}
+
+	n := len(atoms)
+	if n > 3 {
+		n = 3
+	}
+	return AtomFmtETMv4{format_num: n, taken: copyAtoms(atoms[:n])}
+}
+
+func atomsHavePrefix(atoms []bool, prefix []bool) bool {
+	if len(atoms) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if atoms[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copyAtoms(atoms []bool) []bool {
+	return append([]bool(nil), atoms...)
+}
+
+// encodeContinuation writes value as groups seven bit fields, each with bit[7]
+// set while more follow.  Anything left over after the last group is written
+// as a final full byte, as the Timestamp and cycle count payloads do.
+func encodeContinuation(value uint64, groups int) []byte {
+	var out []byte
+	for i := 0; i < groups; i++ {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if value == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+	return append(out, byte(value))
+}
+
+// encodeAtomField is the inverse of the A field of the Mispredict and Cancel
+// Format 2 packets, false for atoms the field can't represent.
+func encodeAtomField(taken []bool) (byte, bool) {
+	switch {
+	case len(taken) == 0:
+		return 0, true
+	case len(taken) == 1 && taken[0] == ATOM_E:
+		return 1, true
+	case len(taken) == 2 && taken[0] == ATOM_E && taken[1] == ATOM_E:
+		return 2, true
+	case len(taken) == 1 && taken[0] == ATOM_N:
+		return 3, true
+	}
+	return 0, false
+}
+
+func littleEndian(value uint64, n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(value >> uint(8*i))
+	}
+	return out
+}
@@ -0,0 +1,242 @@
+package tracepkts
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// decodeAll decodes every packet of data, failing the test on any error.
+func decodeAll(t *testing.T, data []byte, opts Options) ([]TracePacket, *Decoder) {
+	t.Helper()
+	opts.NoSync = true
+	decoder := NewDecoder(bytes.NewReader(data), opts)
+
+	var packets []TracePacket
+	for {
+		pkt, err := decoder.Next()
+		if err == io.EOF {
+			return packets, decoder
+		}
+		if err != nil {
+			t.Fatalf("decoding % x: %v", data, err)
+		}
+		packets = append(packets, pkt)
+	}
+}
+
+func repeatAtoms(atom bool, n int) []bool {
+	atoms := make([]bool, n)
+	for i := range atoms {
+		atoms[i] = atom
+	}
+	return atoms
+}
+
+func TestEncodeAtoms(t *testing.T) {
+	tests := []struct {
+		name   string
+		atoms  []bool
+		format int
+	}{
+		{"format 1", []bool{ATOM_N}, 1},
+		{"format 2", []bool{ATOM_E, ATOM_N}, 2},
+		{"format 3", []bool{ATOM_N, ATOM_E, ATOM_N}, 3},
+		{"format 4", []bool{ATOM_N, ATOM_N, ATOM_N, ATOM_N}, 4},
+		{"format 5", []bool{ATOM_N, ATOM_E, ATOM_N, ATOM_E, ATOM_N}, 5},
+		{"format 6 shortest", []bool{ATOM_E, ATOM_E, ATOM_N}, 6},
+		{"format 6 longest N", append(repeatAtoms(ATOM_E, ATOM_FMT6_MAX_COUNT+2), ATOM_N), 6},
+		{"format 6 longest E", repeatAtoms(ATOM_E, ATOM_FMT6_MAX_COUNT+3), 6},
+		{"format 6 split", repeatAtoms(ATOM_E, 2*(ATOM_FMT6_MAX_COUNT+3)), 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := EncodeAtoms(test.atoms)
+			if format := encoded[0].(AtomFmtETMv4).format_num; format != test.format {
+				t.Errorf("encoded as Atom Format %d, want %d", format, test.format)
+			}
+
+			data, err := Encode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != len(encoded) {
+				t.Errorf("%d atom packets took %d bytes", len(encoded), len(data))
+			}
+
+			decoded, _ := decodeAll(t, data, Options{})
+			var atoms []bool
+			for _, pkt := range decoded {
+				atom_pkt, ok := pkt.(AtomFmtETMv4)
+				if !ok {
+					t.Fatalf("decoded %T, want atoms", pkt)
+				}
+				atoms = append(atoms, atom_pkt.Atoms()...)
+			}
+			if !reflect.DeepEqual(atoms, test.atoms) {
+				t.Errorf("decoded %v, want %v", atoms, test.atoms)
+			}
+		})
+	}
+}
+
+func TestCompressAddress(t *testing.T) {
+	// Each step is compressed against the stack the previous ones left
+	steps := []struct {
+		address uint64
+		is      uint8
+		want    string
+		entry   int
+	}{
+		{0xffff000000001000, 0, "Long64bAddrETMv4", -1},
+		{0xffff000000001040, 0, "CompressedAddrETMv4", -1},
+		{0xffff000000011000, 0, "CompressedAddrETMv4", -1},
+		{0xffff000012345678, 0, "CompressedAddrETMv4", -1},
+		{0xffff000012345678, 1, "CompressedAddrETMv4", -1},
+		{0xffff000012345602, 1, "CompressedAddrETMv4", -1},
+		{0x0000000000400000, 0, "Long64bAddrETMv4", -1},
+		{0xffff000012345678, 1, "ExactAddrETMv4", 2},
+		{0x0000000000400000, 0, "ExactAddrETMv4", 1},
+		{0x0000000000400000, 0, "ExactAddrETMv4", 0},
+	}
+
+	var stack ETMv4AddressStack
+	var packets []TracePacket
+	for _, step := range steps {
+		pkt := CompressAddress(&stack, step.address, step.is)
+		if got := reflect.TypeOf(pkt).Name(); got != step.want {
+			t.Errorf("0x%x IS%d: compressed to %s, want %s", step.address, step.is, got, step.want)
+		}
+		if exact_pkt, ok := pkt.(ExactAddrETMv4); ok && int(exact_pkt.Entry()) != step.entry {
+			t.Errorf("0x%x IS%d: exact match of entry %d, want %d", step.address, step.is, exact_pkt.Entry(), step.entry)
+		}
+		packets = append(packets, pkt)
+	}
+
+	data, err := Encode(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(bytes.NewReader(data), Options{NoSync: true})
+	for _, step := range steps {
+		if _, err := decoder.Next(); err != nil {
+			t.Fatalf("0x%x IS%d: %v", step.address, step.is, err)
+		}
+		elm := decoder.AddressStack().Get(0)
+		if elm.Address() != step.address || elm.IS() != step.is {
+			t.Errorf("decoded 0x%x IS%d, want 0x%x IS%d", elm.Address(), elm.IS(), step.address, step.is)
+		}
+	}
+}
+
+func TestEncodeTimestamp(t *testing.T) {
+	const prev = 0x0123456789abcdef
+
+	tests := []struct {
+		timestamp uint64
+		bits      uint8
+		want      uint64
+	}{
+		{0x55, 7, 0x0123456789abcdd5},
+		{0x0055, 14, 0x0123456789abc055},
+		{0x1fffffffffffff, 56, 0x011fffffffffffff},
+		{0xfedcba9876543210, 64, 0xfedcba9876543210},
+	}
+
+	for _, test := range tests {
+		packets := []TracePacket{
+			TimestampETMv4{timestamp: prev, bits: 64},
+			TimestampETMv4{timestamp: test.timestamp, bits: test.bits},
+		}
+		data, err := Encode(packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, decoder := decodeAll(t, data, Options{})
+		if bits := decoded[1].(TimestampETMv4).bits; bits != test.bits {
+			t.Errorf("%d-bit timestamp decoded as %d bits", test.bits, bits)
+		}
+		if got, _ := decoder.Timestamp(); got != test.want {
+			t.Errorf("%d-bit timestamp 0x%x: merged 0x%x, want 0x%x", test.bits, test.timestamp, got, test.want)
+		}
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		data   []byte
+	}{
+		{"default sizes", nil, []byte{0x81, 0xd1, 0x01, 0x02, 0x03, 0x04, 0x11, 0x22, 0x33, 0x44}},
+		{"no VMID bytes", NewConfig(map[string]uint32{"TRCIDR2": 4 << 5}), []byte{0x81, 0xd1, 0x11, 0x22, 0x33, 0x44}},
+		{"one VMID byte", NewConfig(map[string]uint32{"TRCIDR2": 1<<10 | 4<<5}), []byte{0x81, 0xc2, 0x07, 0x11, 0x22, 0x33, 0x44}},
+		{"no payload", nil, []byte{0x80}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, _ := decodeAll(t, test.data, Options{Config: test.config})
+			if len(decoded) != 1 {
+				t.Fatalf("decoded %d packets, want 1", len(decoded))
+			}
+
+			data, err := Encode(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("encoded % x, want % x", data, test.data)
+			}
+		})
+	}
+}
+
+func TestEncodeAtomField(t *testing.T) {
+	// Mispredict and Cancel Format 2 with every A field
+	for _, header := range []byte{0x30, 0x31, 0x32, 0x33, 0x35, 0x36, 0x37} {
+		decoded, _ := decodeAll(t, []byte{header}, Options{})
+		data, err := Encode(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte{header}) {
+			t.Errorf("encoded % x, want %02x", data, header)
+		}
+	}
+
+	invalid := [][]bool{
+		{ATOM_N, ATOM_N},
+		{ATOM_E, ATOM_N},
+		{ATOM_N, ATOM_E},
+		{ATOM_E, ATOM_E, ATOM_E},
+	}
+	for _, taken := range invalid {
+		if data := (MispredictETMv4{taken: taken}).Encode(); data != nil {
+			t.Errorf("Mispredict %s encoded as % x", atomString(taken), data)
+		}
+		if data := (CancelFmt2ETMv4{taken: taken}).Encode(); data != nil {
+			t.Errorf("Cancel Format 2 %s encoded as % x", atomString(taken), data)
+		}
+	}
+}
+
+func TestEncodeEvent(t *testing.T) {
+	if data := (EventETMv4{}).Encode(); data != nil {
+		t.Errorf("Event without events encoded as % x", data)
+	}
+	for header := byte(0x71); header <= 0x7f; header++ {
+		decoded, _ := decodeAll(t, []byte{header}, Options{})
+		data, err := Encode(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte{header}) {
+			t.Errorf("encoded % x, want %02x", data, header)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tracepkts
+
+import (
+	"fmt"
+)
+
+// TruncatedPacketError is returned when the stream ends, or fails, part way
+// through a packet's payload.
+type TruncatedPacketError struct {
+	Offset int64
+	Header byte
+	Packet string
+	Err    error
+}
+
+// ReservedHeaderError is returned for a header, or a header sub-type, that is
+// reserved in the trace protocol.
+type ReservedHeaderError struct {
+	Offset int64
+	Header byte
+}
+
+// InvalidAtomPatternError is returned for an Atom Format 5 header whose ABC
+// field isn't one of the defined patterns.
+type InvalidAtomPatternError struct {
+	Offset  int64
+	Header  byte
+	Pattern uint8
+}
+
+// MalformedPacketError is returned when a payload contradicts its packet
+// type, such as a non-zero byte part way through an Async.
+type MalformedPacketError struct {
+	Offset int64
+	Header byte
+	Packet string
+	Reason string
+}
+
+func (e *TruncatedPacketError) Error() string {
+	return fmt.Sprintf("offset %d: truncated %s packet (header 0x%02x): %v", e.Offset, e.Packet, e.Header, e.Err)
+}
+
+func (e *TruncatedPacketError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReservedHeaderError) Error() string {
+	return fmt.Sprintf("offset %d: reserved header 0x%02x", e.Offset, e.Header)
+}
+
+func (e *InvalidAtomPatternError) Error() string {
+	return fmt.Sprintf("offset %d: invalid atom pattern 0x%x (header 0x%02x)", e.Offset, e.Pattern, e.Header)
+}
+
+func (e *MalformedPacketError) Error() string {
+	return fmt.Sprintf("offset %d: malformed %s packet (header 0x%02x): %s", e.Offset, e.Packet, e.Header, e.Reason)
+}
+
+// IsPacketError reports whether err was caused by a single bad packet, after
+// which decoding can carry on with the next one.
+func IsPacketError(err error) bool {
+	switch err.(type) {
+	case *TruncatedPacketError, *ReservedHeaderError, *InvalidAtomPatternError, *MalformedPacketError:
+		return true
+	}
+	return false
+}
+
+func truncated(reader *Reader, header byte, packet string, err error) error {
+	return &TruncatedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: packet, Err: err}
+}
+
+func reserved(reader *Reader, header byte) error {
+	return &ReservedHeaderError{Offset: reader.PacketOffset(), Header: header}
+}
+
+func malformed(reader *Reader, header byte, packet string, reason string) error {
+	return &MalformedPacketError{Offset: reader.PacketOffset(), Header: header, Packet: packet, Reason: reason}
+}
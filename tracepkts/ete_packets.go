@@ -0,0 +1,246 @@
+package tracepkts
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Protocol int
+
+const (
+	PROTOCOL_ETMV4 Protocol = iota
+	PROTOCOL_ETE
+)
+
+// ETE exception types with their own packet semantics
+const (
+	ETE_EXCP_PE_RESET   = 0x00
+	ETE_EXCP_TRANS_FAIL = 0x18
+)
+
+type TransStartETE struct {
+	*GenericTracePacketv4
+}
+
+type TransCommitETE struct {
+	*GenericTracePacketv4
+}
+
+type TransFailETE struct {
+	ExceptionETMv4
+}
+
+type PEResetETE struct {
+	ExceptionETMv4
+}
+
+type TimestampMarkerETE struct {
+	*GenericTracePacketv4
+}
+
+type InstrumentationETE struct {
+	*GenericTracePacketv4
+	el    int
+	value uint64
+}
+
+type SourceAddrETE struct {
+	*GenericTracePacketv4
+	addr TracePacket
+}
+
+func ParseProtocol(name string) (Protocol, error) {
+	switch strings.ToLower(name) {
+	case "etmv4", "etm4":
+		return PROTOCOL_ETMV4, nil
+	case "ete":
+		return PROTOCOL_ETE, nil
+	}
+	return PROTOCOL_ETMV4, fmt.Errorf("unknown protocol %q", name)
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case PROTOCOL_ETMV4:
+		return "ETMv4"
+	case PROTOCOL_ETE:
+		return "ETE"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// DecodeProtocolPacket decodes a single packet using the packet set of the
+// given trace protocol.
+func DecodeProtocolPacket(proto Protocol, header byte, reader *Reader) (TracePacket, error) {
+	if proto == PROTOCOL_ETE {
+		return DecodeETEPacket(header, reader)
+	}
+	return DecodePacket(header, reader)
+}
+
+// DecodeETEPacket decodes a single packet from an Embedded Trace Extension
+// stream.  ETE reuses the ETMv4 instruction trace packets, headers that are
+// new or redefined in ETE are handled here.
+func DecodeETEPacket(header byte, reader *Reader) (TracePacket, error) {
+	switch {
+	case header == 0x01:
+		return DecodeTraceInfoETE(header, reader)
+	case header == 0x06:
+		return DecodeExceptionETE(header, reader)
+	case header == 0x09:
+		return DecodeInstrumentation(header, reader)
+	case header == 0x0a:
+		return TransStartETE{GenericTracePacketv4: reader.generic()}, nil
+	case header == 0x0b:
+		return TransCommitETE{GenericTracePacketv4: reader.generic()}, nil
+	case header == 0x88:
+		return TimestampMarkerETE{GenericTracePacketv4: reader.generic()}, nil
+	case header >= 0xb0 && header <= 0xb9:
+		return DecodeSourceAddr(header, reader)
+	}
+	return DecodePacket(header, reader)
+}
+
+// DecodeExceptionETE decodes an Exception packet, promoting the PE reset and
+// transaction failure types to their ETE packets.
+func DecodeExceptionETE(header byte, reader *Reader) (TracePacket, error) {
+	excp, err := DecodeException(header, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	excp_pkt := excp.(ExceptionETMv4)
+	switch excp_pkt.etype {
+	case ETE_EXCP_PE_RESET:
+		return PEResetETE{ExceptionETMv4: excp_pkt}, nil
+	case ETE_EXCP_TRANS_FAIL:
+		return TransFailETE{ExceptionETMv4: excp_pkt}, nil
+	}
+	return excp, nil
+}
+
+func DecodeInstrumentation(header byte, reader *Reader) (TracePacket, error) {
+	pkt := InstrumentationETE{GenericTracePacketv4: reader.generic()}
+
+	info, err := reader.ReadByte()
+	if err != nil {
+		return nil, truncated(reader, header, "Instrumentation", err)
+	}
+	pkt.el = int(info & 0x3)
+
+	for i := 0; i < 8; i++ {
+		value_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Instrumentation", err)
+		}
+		pkt.value |= uint64(value_byte) << uint(8*i)
+	}
+	return pkt, nil
+}
+
+// DecodeSourceAddr decodes the ETE source address packets, which share their
+// payload and compression scheme with the target address packets.
+func DecodeSourceAddr(header byte, reader *Reader) (TracePacket, error) {
+	pkt := SourceAddrETE{GenericTracePacketv4: reader.generic()}
+
+	var err error
+	switch header {
+	case 0xb0, 0xb1, 0xb2:
+		pkt.addr, err = DecodeExactAddr(0x90|header&0x3, reader)
+	case 0xb4:
+		pkt.addr, err = DecodeShortAddr(0x95, reader)
+	case 0xb5:
+		pkt.addr, err = DecodeShortAddr(0x96, reader)
+	case 0xb6:
+		pkt.addr, err = DecodeLong32b(0x9a, reader)
+	case 0xb7:
+		pkt.addr, err = DecodeLong32b(0x9b, reader)
+	case 0xb8:
+		pkt.addr, err = DecodeLong64b(0x9d, reader)
+	case 0xb9:
+		pkt.addr, err = DecodeLong64b(0x9e, reader)
+	default:
+		return nil, reserved(reader, header)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (TransStartETE) String() string {
+	return "Transaction Start"
+}
+
+func (TransCommitETE) String() string {
+	return "Transaction Commit"
+}
+
+func (pkt TransFailETE) String() string {
+	return fmt.Sprintf("Transaction Failure: [E1:E0]: %x", pkt.e1e0)
+}
+
+func (pkt PEResetETE) String() string {
+	return fmt.Sprintf("PE Reset: [E1:E0]: %x", pkt.e1e0)
+}
+
+func (TimestampMarkerETE) String() string {
+	return "Timestamp Marker"
+}
+
+func (pkt InstrumentationETE) EL() int {
+	return pkt.el
+}
+
+func (pkt InstrumentationETE) Value() uint64 {
+	return pkt.value
+}
+
+func (pkt InstrumentationETE) String() string {
+	return fmt.Sprintf("Instrumentation: EL: %d Value: 0x%016x", pkt.el, pkt.value)
+}
+
+// Address returns the embedded address packet, one of Long64bAddrETMv4,
+// CompressedAddrETMv4 or ExactAddrETMv4.
+func (pkt SourceAddrETE) Address() TracePacket {
+	return pkt.addr
+}
+
+func (pkt SourceAddrETE) String() string {
+	return fmt.Sprintf("Source %s", pkt.addr.String())
+}
+
+func (TransStartETE) Encode() []byte {
+	return []byte{0x0a}
+}
+
+func (TransCommitETE) Encode() []byte {
+	return []byte{0x0b}
+}
+
+func (TimestampMarkerETE) Encode() []byte {
+	return []byte{0x88}
+}
+
+func (pkt InstrumentationETE) Encode() []byte {
+	return append([]byte{0x09, byte(pkt.el & 0x3)}, littleEndian(pkt.value, 8)...)
+}
+
+func (pkt SourceAddrETE) Encode() []byte {
+	var header byte
+	switch addr_pkt := pkt.addr.(type) {
+	case ExactAddrETMv4:
+		header = 0xb0 | addr_pkt.Entry()
+	case CompressedAddrETMv4:
+		header = 0xb4 + addr_pkt.is
+		if addr_pkt.width == 32 {
+			header = 0xb6 + addr_pkt.is
+		}
+	case Long64bAddrETMv4:
+		header = 0xb8 + addr_pkt.is
+	default:
+		return nil
+	}
+	return append([]byte{header}, pkt.addr.(EncodablePacket).Encode()[1:]...)
+}
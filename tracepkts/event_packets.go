@@ -1,7 +1,6 @@
 package tracepkts
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 )
@@ -15,15 +14,27 @@ type EventETMv4 struct {
 	event [EVENT_WIDTH]bool
 }
 
-func DecodeEvent(header byte, reader *bufio.Reader) TracePacket {
-	pkt := EventETMv4{}
+func DecodeEvent(header byte, reader *Reader) (TracePacket, error) {
+	pkt := EventETMv4{GenericTracePacketv4: reader.generic()}
 
 	for i := 0; i < EVENT_WIDTH; i++ {
 		if (header>>uint(i))&0x1 == 1 {
 			pkt.event[i] = true
 		}
 	}
-	return pkt
+	return pkt, nil
+}
+
+func (pkt EventETMv4) Events() [EVENT_WIDTH]bool {
+	return pkt.event
+}
+
+// Event reports whether event n of the trace unit's event bus fired.
+func (pkt EventETMv4) Event(n int) bool {
+	if n < 0 || n >= EVENT_WIDTH {
+		return false
+	}
+	return pkt.event[n]
 }
 
 func (pkt EventETMv4) String() string {
@@ -36,3 +47,17 @@ func (pkt EventETMv4) String() string {
 	}
 	return buffer.String()
 }
+
+func (pkt EventETMv4) Encode() []byte {
+	header := byte(0x70)
+	for i := 0; i < EVENT_WIDTH; i++ {
+		if pkt.event[i] {
+			header |= 1 << uint(i)
+		}
+	}
+	if header == 0x70 {
+		// Without any events the header is Ignore
+		return nil
+	}
+	return []byte{header}
+}
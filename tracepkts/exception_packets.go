@@ -1,9 +1,7 @@
 package tracepkts
 
 import (
-	"bufio"
 	"fmt"
-	"log"
 )
 
 type ExceptionETMv4 struct {
@@ -17,6 +15,10 @@ type ExceptionReturnETMv4 struct {
 	*GenericTracePacketv4
 }
 
+type FunctionReturnETMv4 struct {
+	*GenericTracePacketv4
+}
+
 const (
 	PE_RESET = iota
 	DEBUG_HALT
@@ -96,40 +98,90 @@ var etypes = [...]string{
 	"Reserved",
 }
 
-func DecodeException(header byte, reader *bufio.Reader) TracePacket {
-	pkt := ExceptionETMv4{}
+func DecodeException(header byte, reader *Reader) (TracePacket, error) {
+	pkt := ExceptionETMv4{GenericTracePacketv4: reader.generic()}
 
 	eheader_info0, err := reader.ReadByte()
 	if err != nil {
-		log.Println("Error reading stream decoding Exception.")
-		return nil
+		return nil, truncated(reader, header, "Exception", err)
 	}
-	pkt.e1e0 = uint8(eheader_info0&0x6>>5 | eheader_info0&0x1)
+	pkt.e1e0 = uint8(eheader_info0&0x40>>5 | eheader_info0&0x1)
 
 	pkt.etype = uint16(eheader_info0 & 0x3e >> 1)
 
 	if eheader_info0&0x80 == 0x80 {
 		eheader_info1, err := reader.ReadByte()
 		if err != nil {
-			log.Println("Error reading stream decoding Exception.")
-			return nil
+			return nil, truncated(reader, header, "Exception", err)
 		}
-		pkt.etype |= uint16(eheader_info1 & 0x1f)
+		pkt.etype |= uint16(eheader_info1&0x1f) << 5
 		if eheader_info1&0x20 == 0x20 {
 			pkt.p = true
 		}
 	}
-	return pkt
+	return pkt, nil
+}
+
+func DecodeExceptionReturn(header byte, reader *Reader) (TracePacket, error) {
+	return ExceptionReturnETMv4{GenericTracePacketv4: reader.generic()}, nil
+}
+
+// DecodeFunctionReturn handles the v8.3 PAuth function return indicator, the
+// return target is implied by the previous branch rather than an address packet.
+func DecodeFunctionReturn(header byte, reader *Reader) (TracePacket, error) {
+	return FunctionReturnETMv4{GenericTracePacketv4: reader.generic()}, nil
+}
+
+func (pkt ExceptionETMv4) E1E0() uint8 {
+	return pkt.e1e0
+}
+
+func (pkt ExceptionETMv4) Type() uint16 {
+	return pkt.etype
+}
+
+// TypeName returns the architectural name of the exception type.
+func (pkt ExceptionETMv4) TypeName() string {
+	if int(pkt.etype) >= len(etypes) {
+		return fmt.Sprintf("0x%x", pkt.etype)
+	}
+	return etypes[pkt.etype]
 }
 
-func DecodeExceptionReturn(header byte, reader *bufio.Reader) TracePacket {
-	return ExceptionReturnETMv4{}
+func (pkt ExceptionETMv4) P() bool {
+	return pkt.p
 }
 
 func (pkt ExceptionETMv4) String() string {
-	return fmt.Sprintf("Exception: [E1:E0]: %x Type: %s", pkt.e1e0, etypes[pkt.etype])
+	return fmt.Sprintf("Exception: [E1:E0]: %x Type: %s", pkt.e1e0, pkt.TypeName())
 }
 
 func (ExceptionReturnETMv4) String() string {
 	return "Exception Return"
 }
+
+func (FunctionReturnETMv4) String() string {
+	return "Function Return"
+}
+
+func (pkt ExceptionETMv4) Encode() []byte {
+	info0 := (pkt.e1e0&0x2)<<5 | pkt.e1e0&0x1 | byte(pkt.etype&0x1f)<<1
+
+	if pkt.etype <= 0x1f && !pkt.p {
+		return []byte{0x06, info0}
+	}
+
+	info1 := byte(pkt.etype>>5) & 0x1f
+	if pkt.p {
+		info1 |= 0x20
+	}
+	return []byte{0x06, info0 | 0x80, info1}
+}
+
+func (ExceptionReturnETMv4) Encode() []byte {
+	return []byte{0x07}
+}
+
+func (FunctionReturnETMv4) Encode() []byte {
+	return []byte{0x05}
+}
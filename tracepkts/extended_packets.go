@@ -1,8 +1,7 @@
 package tracepkts
 
 import (
-	"bufio"
-	"log"
+	"fmt"
 )
 
 type AsyncETMv4 struct {
@@ -13,38 +12,45 @@ type OverflowETMv4 struct {
 	*GenericTracePacketv4
 }
 
-func DecodeAsync(header byte, reader *bufio.Reader) TracePacket {
+type IgnoreETMv4 struct {
+	*GenericTracePacketv4
+}
+
+func DecodeAsync(header byte, reader *Reader) (TracePacket, error) {
 	async_byte_count := 0
 
 	for async_byte_count < 10 {
 		next_byte, err := reader.ReadByte()
 		if err != nil {
-			log.Println("Error reading file looking for another async byte.")
+			return nil, truncated(reader, header, "Async", err)
 		}
-		if next_byte == 0x00 {
-			async_byte_count++
-		} else {
-			log.Printf("Unexpected byte in async pkt decode: %x", next_byte)
+		if next_byte != 0x00 {
+			return nil, malformed(reader, header, "Async", fmt.Sprintf("unexpected byte 0x%02x", next_byte))
 		}
+		async_byte_count++
 	}
 	last_byte, err := reader.ReadByte()
-
-	if err != nil || last_byte != 0x80 {
-		log.Printf("Failed to detect ASYNC Packet")
-		return nil
+	if err != nil {
+		return nil, truncated(reader, header, "Async", err)
+	}
+	if last_byte != 0x80 {
+		return nil, malformed(reader, header, "Async", fmt.Sprintf("unexpected terminator 0x%02x", last_byte))
 	}
-	return AsyncETMv4{}
+	return AsyncETMv4{GenericTracePacketv4: reader.generic()}, nil
 }
 
-func DecodeOverflow(header byte, reader *bufio.Reader) TracePacket {
+func DecodeOverflow(header byte, reader *Reader) (TracePacket, error) {
 	// Payload byte is meaningless
 	_, err := reader.ReadByte()
 
 	if err != nil {
-		log.Printf("Error trying to read payload byte of Overflow")
-		return nil
+		return nil, truncated(reader, header, "Overflow", err)
 	}
-	return OverflowETMv4{}
+	return OverflowETMv4{GenericTracePacketv4: reader.generic()}, nil
+}
+
+func DecodeIgnore(header byte, reader *Reader) (TracePacket, error) {
+	return IgnoreETMv4{GenericTracePacketv4: reader.generic()}, nil
 }
 
 func (AsyncETMv4) String() string {
@@ -54,3 +60,19 @@ func (AsyncETMv4) String() string {
 func (OverflowETMv4) String() string {
 	return "Overflow"
 }
+
+func (IgnoreETMv4) String() string {
+	return "Ignore"
+}
+
+func (AsyncETMv4) Encode() []byte {
+	return []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80}
+}
+
+func (OverflowETMv4) Encode() []byte {
+	return []byte{0x00, 0x05}
+}
+
+func (IgnoreETMv4) Encode() []byte {
+	return []byte{0x70}
+}
@@ -0,0 +1,100 @@
+package tracepkts
+
+import (
+	"fmt"
+)
+
+type QETMv4 struct {
+	*GenericTracePacketv4
+	qtype       uint8
+	count_valid bool
+	count       uint32
+	addr        TracePacket
+}
+
+func DecodeQ(header byte, reader *Reader) (TracePacket, error) {
+	pkt := QETMv4{GenericTracePacketv4: reader.generic(), qtype: uint8(header & 0xf), count_valid: true}
+
+	// Optional address payload precedes the instruction count
+	var err error
+	switch pkt.qtype {
+	case 0x0, 0x1, 0x2:
+		pkt.addr, err = DecodeExactAddr(0x90|byte(pkt.qtype), reader)
+	case 0x5:
+		pkt.addr, err = DecodeShortAddr(0x95, reader)
+	case 0x6:
+		pkt.addr, err = DecodeShortAddr(0x96, reader)
+	case 0xa:
+		pkt.addr, err = DecodeLong32b(0x9a, reader)
+	case 0xb:
+		pkt.addr, err = DecodeLong32b(0x9b, reader)
+	case 0xc:
+		// Count only
+	case 0xf:
+		// Neither count nor address
+		pkt.count_valid = false
+		return pkt, nil
+	default:
+		return nil, reserved(reader, header)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 5; i++ {
+		count_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Q", err)
+		}
+
+		pkt.count |= uint32(count_byte&0x7f) << uint(i*7)
+
+		if count_byte&0x80 == 0 {
+			break
+		}
+	}
+	return pkt, nil
+}
+
+func (pkt QETMv4) Count() uint32 {
+	return pkt.count
+}
+
+func (pkt QETMv4) CountValid() bool {
+	return pkt.count_valid
+}
+
+// Address returns the embedded address packet, either a CompressedAddrETMv4
+// or an ExactAddrETMv4, or nil when the Q packet carries no address.
+func (pkt QETMv4) Address() TracePacket {
+	return pkt.addr
+}
+
+func (pkt QETMv4) String() string {
+	if !pkt.count_valid {
+		return "Q: Count Unknown"
+	}
+	if pkt.addr == nil {
+		return fmt.Sprintf("Q: Count: %d", pkt.count)
+	}
+	return fmt.Sprintf("Q: Count: %d %s", pkt.count, pkt.addr.String())
+}
+
+func (pkt QETMv4) Encode() []byte {
+	out := []byte{0xa0 | pkt.qtype}
+
+	if pkt.addr != nil {
+		addr_pkt, ok := pkt.addr.(EncodablePacket)
+		if !ok {
+			return nil
+		}
+		// Q carries the address packet's payload under its own header
+		out = append(out, addr_pkt.Encode()[1:]...)
+	}
+
+	if pkt.count_valid {
+		out = append(out, encodeContinuation(uint64(pkt.count), 5)...)
+	}
+	return out
+}
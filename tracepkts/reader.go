@@ -0,0 +1,127 @@
+package tracepkts
+
+import (
+	"bufio"
+	"io"
+)
+
+// Reader buffers a trace stream for the packet decoders and keeps track of
+// the absolute stream offset of every byte consumed, so decode errors can
+// point at the packet that caused them.
+type Reader struct {
+	reader  *bufio.Reader
+	pending []byte
+	offset  int64
+	packet  int64
+	current *GenericTracePacketv4
+	config  *Config
+	// Cycle counting threshold of the last Trace Info, overriding the Config
+	cc_threshold       uint32
+	cc_threshold_valid bool
+}
+
+func NewReader(in io.Reader) *Reader {
+	return NewReaderAt(in, 0)
+}
+
+// NewReaderAt creates a Reader whose first byte is at offset in the stream,
+// for inputs that have already been partially consumed.
+func NewReaderAt(in io.Reader, offset int64) *Reader {
+	return &Reader{reader: bufio.NewReader(in), offset: offset, packet: offset}
+}
+
+// ReadHeader reads the header byte of the next packet and marks its offset as
+// the start of that packet.  Every byte read until the next header is kept as
+// the raw bytes of the packet.
+func (r *Reader) ReadHeader() (byte, error) {
+	r.packet = r.offset
+	r.current = &GenericTracePacketv4{offset: r.offset}
+
+	b, err := r.ReadByte()
+	r.current.header = b
+	return b, err
+}
+
+func (r *Reader) ReadByte() (byte, error) {
+	var b byte
+	var err error
+	if len(r.pending) > 0 {
+		b, r.pending = r.pending[0], r.pending[1:]
+	} else {
+		b, err = r.reader.ReadByte()
+	}
+	if err == nil {
+		r.offset++
+		if r.current != nil {
+			r.current.raw = append(r.current.raw, b)
+		}
+	}
+	return b, err
+}
+
+// Peek returns the next n bytes without consuming them.
+func (r *Reader) Peek(n int) ([]byte, error) {
+	if len(r.pending) >= n {
+		return r.pending[:n], nil
+	}
+	buffered, err := r.reader.Peek(n - len(r.pending))
+	return append(append([]byte(nil), r.pending...), buffered...), err
+}
+
+// unread pushes b back in front of the stream, to be read again from the
+// offset it was first read at.
+func (r *Reader) unread(b []byte) {
+	r.pending = append(append([]byte(nil), b...), r.pending...)
+	r.offset -= int64(len(b))
+}
+
+// Offset returns the stream offset of the next unread byte.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// PacketBytes returns the bytes read since the last ReadHeader.
+func (r *Reader) PacketBytes() []byte {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.raw
+}
+
+// SetConfig describes the trace unit for packets whose layout depends on it.
+func (r *Reader) SetConfig(config *Config) {
+	r.config = config
+}
+
+// Config returns the trace unit description, which may be nil when none was
+// given.  A nil Config behaves as DefaultConfig.
+func (r *Reader) Config() *Config {
+	return r.config
+}
+
+// CCThreshold returns the cycle counting threshold cycle count packets are
+// relative to, from the last Trace Info that carried one or else the Config.
+func (r *Reader) CCThreshold() uint32 {
+	if r.cc_threshold_valid {
+		return r.cc_threshold
+	}
+	return r.config.CCThreshold()
+}
+
+// setCCThreshold overrides the Config threshold, until cleared with valid
+// false.
+func (r *Reader) setCCThreshold(threshold uint32, valid bool) {
+	r.cc_threshold, r.cc_threshold_valid = threshold, valid
+}
+
+// generic returns the shared packet data of the packet being decoded, which
+// keeps collecting raw bytes until the decode completes.
+func (r *Reader) generic() *GenericTracePacketv4 {
+	return r.current
+}
+
+// PacketOffset returns the stream offset of the header of the packet being
+// decoded.
+func (r *Reader) PacketOffset() int64 {
+	return r.packet
+}
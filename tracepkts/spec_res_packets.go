@@ -1,9 +1,7 @@
 package tracepkts
 
 import (
-	"bufio"
 	"fmt"
-	"log"
 )
 
 type CommitETMv4 struct {
@@ -11,24 +9,228 @@ type CommitETMv4 struct {
 	commit uint32
 }
 
-func DecodeCommit(header byte, reader *bufio.Reader) TracePacket {
-	pkt := CommitETMv4{}
+type MispredictETMv4 struct {
+	*GenericTracePacketv4
+	taken []bool
+}
+
+type DiscardETMv4 struct {
+	*GenericTracePacketv4
+}
+
+type CancelFmt1ETMv4 struct {
+	*GenericTracePacketv4
+	cancel     uint32
+	mispredict bool
+}
+
+type CancelFmt2ETMv4 struct {
+	*GenericTracePacketv4
+	taken []bool
+}
+
+type CancelFmt3ETMv4 struct {
+	*GenericTracePacketv4
+	cancel uint32
+	taken  []bool
+}
+
+func DecodeCommit(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CommitETMv4{GenericTracePacketv4: reader.generic()}
 	for i := 0; ; i++ {
 		commit_byte, err := reader.ReadByte()
 		if err != nil {
-			log.Println("Error reading stream decoding Commit.")
-			return nil
+			return nil, truncated(reader, header, "Commit", err)
 		}
 
-		pkt.commit |= uint32(commit_byte & 0x7f << uint(i*7))
+		pkt.commit |= uint32(commit_byte&0x7f) << uint(i*7)
 
 		if commit_byte&0x80 == 0 {
 			break
 		}
 	}
-	return pkt
+	return pkt, nil
+}
+
+func DecodeMispredict(header byte, reader *Reader) (TracePacket, error) {
+	pkt := MispredictETMv4{GenericTracePacketv4: reader.generic()}
+
+	// A field optionally flips the atoms of the mispredicted P0 element
+	switch header & 0x3 {
+	case 1:
+		pkt.taken = []bool{ATOM_E}
+	case 2:
+		pkt.taken = []bool{ATOM_E, ATOM_E}
+	case 3:
+		pkt.taken = []bool{ATOM_N}
+	}
+	return pkt, nil
+}
+
+func DecodeDiscard(header byte, reader *Reader) (TracePacket, error) {
+	// Consume the extension byte following the 0x00 header
+	_, err := reader.ReadByte()
+
+	if err != nil {
+		return nil, truncated(reader, header, "Discard", err)
+	}
+	return DiscardETMv4{GenericTracePacketv4: reader.generic()}, nil
+}
+
+func DecodeCancelFmt1(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CancelFmt1ETMv4{GenericTracePacketv4: reader.generic()}
+
+	if header&0x1 == 1 {
+		pkt.mispredict = true
+	}
+
+	for i := 0; i < 5; i++ {
+		cancel_byte, err := reader.ReadByte()
+		if err != nil {
+			return nil, truncated(reader, header, "Cancel Format 1", err)
+		}
+
+		pkt.cancel |= uint32(cancel_byte&0x7f) << uint(i*7)
+
+		if cancel_byte&0x80 == 0 {
+			break
+		}
+	}
+	return pkt, nil
+}
+
+func DecodeCancelFmt2(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CancelFmt2ETMv4{GenericTracePacketv4: reader.generic()}
+
+	// A field encodes the atom(s) following the single cancelled element
+	switch header & 0x3 {
+	case 1:
+		pkt.taken = []bool{ATOM_E}
+	case 2:
+		pkt.taken = []bool{ATOM_E, ATOM_E}
+	case 3:
+		pkt.taken = []bool{ATOM_N}
+	default:
+		// 0b00110100 is reserved
+		return nil, reserved(reader, header)
+	}
+	return pkt, nil
+}
+
+func DecodeCancelFmt3(header byte, reader *Reader) (TracePacket, error) {
+	pkt := CancelFmt3ETMv4{GenericTracePacketv4: reader.generic()}
+
+	pkt.cancel = uint32(header>>1&0x3) + 2
+
+	if header&0x1 == 1 {
+		pkt.taken = []bool{ATOM_E}
+	}
+	return pkt, nil
+}
+
+func (pkt CommitETMv4) Commit() uint32 {
+	return pkt.commit
 }
 
 func (pkt CommitETMv4) String() string {
 	return fmt.Sprintf("Commit %d", pkt.commit)
 }
+
+func (pkt MispredictETMv4) Atoms() []bool {
+	return pkt.taken
+}
+
+func (pkt MispredictETMv4) String() string {
+	if len(pkt.taken) == 0 {
+		return "Mispredict"
+	}
+	return fmt.Sprintf("Mispredict Branch(es): %s", atomString(pkt.taken))
+}
+
+func (DiscardETMv4) String() string {
+	return "Discard"
+}
+
+func (pkt CancelFmt1ETMv4) Cancel() uint32 {
+	return pkt.cancel
+}
+
+func (pkt CancelFmt1ETMv4) Mispredict() bool {
+	return pkt.mispredict
+}
+
+func (pkt CancelFmt1ETMv4) String() string {
+	return fmt.Sprintf("Cancel Format 1: Cancel: %d Mispredict: %t", pkt.cancel, pkt.mispredict)
+}
+
+func (pkt CancelFmt2ETMv4) Cancel() uint32 {
+	// Format 2 always cancels a single P0 element
+	return 1
+}
+
+func (pkt CancelFmt2ETMv4) Atoms() []bool {
+	return pkt.taken
+}
+
+func (pkt CancelFmt2ETMv4) String() string {
+	return fmt.Sprintf("Cancel Format 2: Cancel: %d Branch(es): %s", pkt.Cancel(), atomString(pkt.taken))
+}
+
+func (pkt CancelFmt3ETMv4) Cancel() uint32 {
+	return pkt.cancel
+}
+
+func (pkt CancelFmt3ETMv4) Atoms() []bool {
+	return pkt.taken
+}
+
+func (pkt CancelFmt3ETMv4) String() string {
+	if len(pkt.taken) == 0 {
+		return fmt.Sprintf("Cancel Format 3: Cancel: %d", pkt.cancel)
+	}
+	return fmt.Sprintf("Cancel Format 3: Cancel: %d Branch(es): %s", pkt.cancel, atomString(pkt.taken))
+}
+
+func (pkt CommitETMv4) Encode() []byte {
+	return append([]byte{0x2d}, encodeContinuation(uint64(pkt.commit), 5)...)
+}
+
+func (pkt MispredictETMv4) Encode() []byte {
+	a, ok := encodeAtomField(pkt.taken)
+	if !ok {
+		return nil
+	}
+	return []byte{0x30 | a}
+}
+
+func (DiscardETMv4) Encode() []byte {
+	return []byte{0x00, 0x03}
+}
+
+func (pkt CancelFmt1ETMv4) Encode() []byte {
+	header := byte(0x2e)
+	if pkt.mispredict {
+		header |= 0x1
+	}
+	return append([]byte{header}, encodeContinuation(uint64(pkt.cancel), 5)...)
+}
+
+func (pkt CancelFmt2ETMv4) Encode() []byte {
+	a, ok := encodeAtomField(pkt.taken)
+	if !ok || a == 0 {
+		// 0b00110100 is reserved
+		return nil
+	}
+	return []byte{0x34 | a}
+}
+
+func (pkt CancelFmt3ETMv4) Encode() []byte {
+	if pkt.cancel < 2 || pkt.cancel > 5 {
+		return nil
+	}
+	header := 0x38 | byte(pkt.cancel-2)<<1
+	if len(pkt.taken) > 0 {
+		header |= 0x1
+	}
+	return []byte{header}
+}
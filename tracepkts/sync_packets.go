@@ -1,10 +1,8 @@
 package tracepkts
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
-	"log"
 )
 
 type TraceInfoETMv4 struct {
@@ -17,6 +15,8 @@ type TraceInfoETMv4 struct {
 	curr_spec_depth uint32
 	cc_threshold    uint32
 	p0_key_max      uint8
+	ete             bool
+	tstate          bool
 }
 
 type TraceOnETMv4 struct {
@@ -26,19 +26,29 @@ type TraceOnETMv4 struct {
 type TimestampETMv4 struct {
 	*GenericTracePacketv4
 	timestamp         uint64
+	bits              uint8
 	cycle_count_valid bool
 	cycle_count       uint32
 }
 
-func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
-	pkt := TraceInfoETMv4{}
+func DecodeTraceInfo(header byte, reader *Reader) (TracePacket, error) {
+	return decodeTraceInfo(header, reader, false)
+}
+
+// DecodeTraceInfoETE decodes the ETE variant of Trace Info, which extends the
+// INFO section with the transactional state of the PE.
+func DecodeTraceInfoETE(header byte, reader *Reader) (TracePacket, error) {
+	return decodeTraceInfo(header, reader, true)
+}
+
+func decodeTraceInfo(header byte, reader *Reader, ete bool) (TracePacket, error) {
+	pkt := TraceInfoETMv4{GenericTracePacketv4: reader.generic(), ete: ete}
 
 	// ETMv4 only specifies one byte for PLCTL
 	plctl, err := reader.ReadByte()
 
 	if err != nil {
-		log.Println("Error reading byte for Trace Info packet decode.")
-		return nil
+		return nil, truncated(reader, header, "Trace Info", err)
 	}
 
 	pkt.plctl = uint8(plctl)
@@ -48,8 +58,7 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 		info, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Trace Info byte for INFO block.")
-			return nil
+			return nil, truncated(reader, header, "Trace Info", err)
 		}
 
 		if info&0x1 == 1 {
@@ -71,14 +80,29 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 		} else {
 			pkt.p0_store = false
 		}
+
+		if ete {
+			if info&0x40 == 0x40 {
+				pkt.tstate = true
+			}
+
+			// ETE allows INFO to be extended, skip any bits this decoder
+			// doesn't know about
+			for info&0x80 == 0x80 {
+				info, err = reader.ReadByte()
+
+				if err != nil {
+					return nil, truncated(reader, header, "Trace Info", err)
+				}
+			}
+		}
 	}
 	// KEY section
 	if plctl&0x2 == 0x2 {
 		key, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Trace Info byte for KEY block.")
-			return nil
+			return nil, truncated(reader, header, "Trace Info", err)
 		}
 
 		pkt.p0_key_max = uint8(key)
@@ -88,8 +112,7 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 		spec, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Trace Info byte for SPEC block.")
-			return nil
+			return nil, truncated(reader, header, "Trace Info", err)
 		}
 
 		pkt.curr_spec_depth = uint32(spec & 0x7f)
@@ -98,11 +121,10 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 			if spec&0x80 == 0x80 {
 				spec, err = reader.ReadByte()
 				if err != nil {
-					log.Println("Error reading Trace Info byte for SPEC block.")
-					return nil
+					return nil, truncated(reader, header, "Trace Info", err)
 				}
 
-				pkt.curr_spec_depth |= uint32(spec & 0x7f << uint(7*i))
+				pkt.curr_spec_depth |= uint32(spec&0x7f) << uint(7*(i+1))
 			} else {
 				break
 			}
@@ -113,8 +135,7 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 		cyct0, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Trace Info byte for CYCT block.")
-			return nil
+			return nil, truncated(reader, header, "Trace Info", err)
 		}
 
 		pkt.cc_threshold = uint32(cyct0 & 0x7f)
@@ -123,23 +144,22 @@ func DecodeTraceInfo(header byte, reader *bufio.Reader) TracePacket {
 			cyct1, err := reader.ReadByte()
 
 			if err != nil {
-				log.Println("Error reading Trace Info byte for CYCT block.")
-				return nil
+				return nil, truncated(reader, header, "Trace Info", err)
 			}
 
-			pkt.cc_threshold |= uint32(cyct1 & 0x1f << 7)
+			pkt.cc_threshold |= uint32(cyct1&0x1f) << 7
 		}
 	}
-	return pkt
+	return pkt, nil
 }
 
-func DecodeTraceOn(header byte, reader *bufio.Reader) TracePacket {
-	pkt := TraceOnETMv4{}
-	return pkt
+func DecodeTraceOn(header byte, reader *Reader) (TracePacket, error) {
+	pkt := TraceOnETMv4{GenericTracePacketv4: reader.generic()}
+	return pkt, nil
 }
 
-func DecodeTimestamp(header byte, reader *bufio.Reader) TracePacket {
-	pkt := TimestampETMv4{}
+func DecodeTimestamp(header byte, reader *Reader) (TracePacket, error) {
+	pkt := TimestampETMv4{GenericTracePacketv4: reader.generic()}
 
 	if header&0x1 == 1 {
 		pkt.cycle_count_valid = true
@@ -150,11 +170,11 @@ func DecodeTimestamp(header byte, reader *bufio.Reader) TracePacket {
 		ts_byte, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Timestamp byte.")
-			return nil
+			return nil, truncated(reader, header, "Timestamp", err)
 		}
 
 		pkt.timestamp |= uint64(ts_byte&0x7f) << uint(ts_pos*7)
+		pkt.bits += 7
 		if ts_byte&0x80 == 0 {
 			break
 		}
@@ -164,11 +184,11 @@ func DecodeTimestamp(header byte, reader *bufio.Reader) TracePacket {
 		ts_byte, err := reader.ReadByte()
 
 		if err != nil {
-			log.Println("Error reading Timestamp byte.")
-			return nil
+			return nil, truncated(reader, header, "Timestamp", err)
 		}
 
 		pkt.timestamp |= uint64(ts_byte) << 56
+		pkt.bits = 64
 	}
 
 	if pkt.cycle_count_valid {
@@ -180,11 +200,10 @@ func DecodeTimestamp(header byte, reader *bufio.Reader) TracePacket {
 			count_byte, err = reader.ReadByte()
 
 			if err != nil {
-				log.Println("Error reading Timestamp byte.")
-				return nil
+				return nil, truncated(reader, header, "Timestamp", err)
 			}
 
-			pkt.cycle_count |= uint32(count_byte & 0x7f << uint(count_pos*7))
+			pkt.cycle_count |= uint32(count_byte&0x7f) << uint(count_pos*7)
 
 			if count_byte&0x80 == 0 {
 				break
@@ -196,28 +215,100 @@ func DecodeTimestamp(header byte, reader *bufio.Reader) TracePacket {
 			count_byte, err = reader.ReadByte()
 
 			if err != nil {
-				log.Println("Error reading Timestamp byte.")
-				return nil
+				return nil, truncated(reader, header, "Timestamp", err)
 			}
 
 			pkt.cycle_count |= uint32(count_byte&0x3f) << 14
 		}
 	}
-	return pkt
+	return pkt, nil
+}
+
+func (pkt TraceInfoETMv4) PLCTL() uint8 {
+	return pkt.plctl
+}
+
+func (pkt TraceInfoETMv4) CCEnabled() bool {
+	return pkt.cc_enabled
+}
+
+func (pkt TraceInfoETMv4) CondEnabled() uint8 {
+	return pkt.cond_enabled
+}
+
+func (pkt TraceInfoETMv4) P0Load() bool {
+	return pkt.p0_load
+}
+
+func (pkt TraceInfoETMv4) P0Store() bool {
+	return pkt.p0_store
+}
+
+func (pkt TraceInfoETMv4) CurrSpecDepth() uint32 {
+	return pkt.curr_spec_depth
+}
+
+func (pkt TraceInfoETMv4) CCThreshold() uint32 {
+	return pkt.cc_threshold
+}
+
+func (pkt TraceInfoETMv4) P0KeyMax() uint8 {
+	return pkt.p0_key_max
+}
+
+// TState reports the transactional state of the PE, only ever set by ETE.
+func (pkt TraceInfoETMv4) TState() bool {
+	return pkt.tstate
 }
 
 func (pkt TraceInfoETMv4) String() string {
-	return fmt.Sprintf("Trace Info: PLCTL: 0x%x cc_enabled: %t cond_enabled: 0x%x p0_load: %t p0_store: %t curr_spec_depth: 0x%x cc_threshold: 0x%x p0_key_max: 0x%x", pkt.plctl, pkt.cc_enabled, pkt.cond_enabled, pkt.p0_load, pkt.p0_store, pkt.curr_spec_depth, pkt.cc_threshold, pkt.p0_key_max)
+	info := fmt.Sprintf("Trace Info: PLCTL: 0x%x cc_enabled: %t cond_enabled: 0x%x p0_load: %t p0_store: %t curr_spec_depth: 0x%x cc_threshold: 0x%x p0_key_max: 0x%x", pkt.plctl, pkt.cc_enabled, pkt.cond_enabled, pkt.p0_load, pkt.p0_store, pkt.curr_spec_depth, pkt.cc_threshold, pkt.p0_key_max)
+	if pkt.ete {
+		info += fmt.Sprintf(" tstate: %t", pkt.tstate)
+	}
+	return info
 }
 
 func (TraceOnETMv4) String() string {
 	return "Trace On"
 }
 
+// Timestamp returns the low order bits of the timestamp carried by the
+// packet, see Bits and CurrentTimestamp for the full value.
+func (pkt TimestampETMv4) Timestamp() uint64 {
+	return pkt.timestamp
+}
+
+// Bits returns how many low order timestamp bits the packet replaces.
+func (pkt TimestampETMv4) Bits() uint8 {
+	return pkt.bits
+}
+
+// Merge applies the packet to the previous full timestamp.
+func (pkt TimestampETMv4) Merge(prev uint64) uint64 {
+	if pkt.bits >= 64 {
+		return pkt.timestamp
+	}
+	mask := uint64(1)<<pkt.bits - 1
+	return prev&^mask | pkt.timestamp&mask
+}
+
+func (pkt TimestampETMv4) CycleCountValid() bool {
+	return pkt.cycle_count_valid
+}
+
+func (pkt TimestampETMv4) CycleCount() uint32 {
+	return pkt.cycle_count
+}
+
 func (pkt TimestampETMv4) String() string {
 	var buffer bytes.Buffer
 
-	buffer.WriteString(fmt.Sprintf("Timestamp: 0x%x", pkt.timestamp))
+	if ts, ok := pkt.CurrentTimestamp(); ok {
+		buffer.WriteString(fmt.Sprintf("Timestamp: 0x%x (%d-bit update 0x%x)", ts, pkt.bits, pkt.timestamp))
+	} else {
+		buffer.WriteString(fmt.Sprintf("Timestamp: 0x%x", pkt.timestamp))
+	}
 
 	if pkt.cycle_count_valid {
 		buffer.WriteString(fmt.Sprintf(" Cycle Count: 0x%x", pkt.cycle_count))
@@ -225,3 +316,64 @@ func (pkt TimestampETMv4) String() string {
 
 	return buffer.String()
 }
+
+func (pkt TraceInfoETMv4) Encode() []byte {
+	out := []byte{0x01, pkt.plctl}
+
+	if pkt.plctl&0x1 == 1 {
+		info := pkt.cond_enabled << 1 & 0xe
+		if pkt.cc_enabled {
+			info |= 0x01
+		}
+		if pkt.p0_load {
+			info |= 0x10
+		}
+		if pkt.p0_store {
+			info |= 0x20
+		}
+		if pkt.ete && pkt.tstate {
+			info |= 0x40
+		}
+		out = append(out, info)
+	}
+	if pkt.plctl&0x2 == 0x2 {
+		out = append(out, pkt.p0_key_max)
+	}
+	if pkt.plctl&0x4 == 0x4 {
+		out = append(out, encodeContinuation(uint64(pkt.curr_spec_depth), 5)...)
+	}
+	if pkt.plctl&0x8 == 0x8 {
+		out = append(out, byte(pkt.cc_threshold&0x7f))
+		if pkt.cc_threshold > 0x7f {
+			out[len(out)-1] |= 0x80
+			out = append(out, byte(pkt.cc_threshold>>7)&0x1f)
+		}
+	}
+	return out
+}
+
+func (TraceOnETMv4) Encode() []byte {
+	return []byte{0x04}
+}
+
+func (pkt TimestampETMv4) Encode() []byte {
+	out := []byte{0x02}
+	if pkt.bits == 0 || pkt.bits >= 64 {
+		out = append(out, encodeContinuation(pkt.timestamp, 8)...)
+	} else {
+		// Keep the width, high zero bits still replace the previous value
+		for i := uint8(0); i < pkt.bits; i += 7 {
+			b := byte(pkt.timestamp>>i) & 0x7f
+			if i+7 < pkt.bits {
+				b |= 0x80
+			}
+			out = append(out, b)
+		}
+	}
+
+	if pkt.cycle_count_valid {
+		out[0] |= 0x1
+		out = append(out, encodeContinuation(uint64(pkt.cycle_count), 2)...)
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package tracepkts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SysfsSource is an ETM or ETE as described by a copy of its Linux CoreSight
+// sysfs directory, /sys/bus/coresight/devices/etm<N> or ete<N>.
+type SysfsSource struct {
+	name     string
+	cpu      int
+	trace_id uint64
+	config   *Config
+}
+
+// Registers read from a sysfs ETM directory, by file.  Kernels have named the
+// trace ID file differently over time, the first found wins.
+var sysfsRegisters = []struct {
+	file     string
+	register string
+}{
+	{"mgmt/trcconfig", TRCCONFIGR},
+	{"mgmt/trctraceid", TRCTRACEIDR},
+	{"mgmt/trctraceidr", TRCTRACEIDR},
+	{"traceid", TRCTRACEIDR},
+	{"trcidr/trcidr0", "TRCIDR0"},
+	{"trcidr/trcidr1", "TRCIDR1"},
+	{"trcidr/trcidr2", "TRCIDR2"},
+	{"trcidr/trcidr3", "TRCIDR3"},
+	{"trcidr/trcidr4", "TRCIDR4"},
+	{"trcidr/trcidr5", "TRCIDR5"},
+	{"trcidr/trcidr6", "TRCIDR6"},
+	{"trcidr/trcidr7", "TRCIDR7"},
+	{"trcidr/trcidr8", "TRCIDR8"},
+	{"trcidr/trcidr9", "TRCIDR9"},
+	{"trcidr/trcidr10", "TRCIDR10"},
+	{"trcidr/trcidr11", "TRCIDR11"},
+	{"trcidr/trcidr12", "TRCIDR12"},
+	{"trcidr/trcidr13", "TRCIDR13"},
+	{"cyc_threshold", TRCCCCTLR},
+}
+
+// LoadSysfs reads every ETM in a copied sysfs tree.  dir may be the root of
+// the copy, the coresight devices directory or a single etm<N> or ete<N>
+// directory.
+func LoadSysfs(dir string) ([]SysfsSource, error) {
+	for _, devices := range []string{filepath.Join(dir, "sys/bus/coresight/devices"), filepath.Join(dir, "bus/coresight/devices"), dir} {
+		var etms []string
+		for _, pattern := range []string{"etm*", "ete*"} {
+			matches, err := filepath.Glob(filepath.Join(devices, pattern))
+			if err != nil {
+				return nil, err
+			}
+			etms = append(etms, matches...)
+		}
+		if len(etms) > 0 {
+			return loadSysfsETMs(etms)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "trcidr")); err == nil {
+		return loadSysfsETMs([]string{dir})
+	}
+	return nil, fmt.Errorf("sysfs: no etm or ete devices found in %s", dir)
+}
+
+func loadSysfsETMs(etms []string) ([]SysfsSource, error) {
+	var sources []SysfsSource
+	for _, etm := range etms {
+		source, err := LoadSysfsETM(etm)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].cpu < sources[j].cpu })
+	return sources, nil
+}
+
+// LoadSysfsETM reads a single sysfs etm<N> or ete<N> directory.
+func LoadSysfsETM(dir string) (SysfsSource, error) {
+	source := SysfsSource{name: filepath.Base(dir), cpu: -1, config: NewConfig(nil)}
+	found := make(map[string]bool)
+
+	for _, reg := range sysfsRegisters {
+		if found[reg.register] {
+			continue
+		}
+		value, ok, err := readSysfsValue(filepath.Join(dir, reg.file))
+		if err != nil {
+			return source, err
+		}
+		if ok {
+			source.config.Set(reg.register, uint32(value))
+			found[reg.register] = true
+		}
+	}
+
+	if cpu, ok, err := readSysfsValue(filepath.Join(dir, "cpu")); err != nil {
+		return source, err
+	} else if ok {
+		source.cpu = int(cpu)
+	}
+
+	trace_id, ok := source.config.TraceID()
+	if !ok {
+		return source, fmt.Errorf("sysfs: %s has no trace ID", dir)
+	}
+	source.trace_id = uint64(trace_id)
+
+	return source, nil
+}
+
+// readSysfsValue reads a number from an attribute file, which the kernel
+// prints as "0x%x" for registers and decimal for the rest.  A missing file
+// returns false rather than an error.
+func readSysfsValue(path string) (uint64, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("sysfs: %s: %v", path, err)
+	}
+	return value, true, nil
+}
+
+// Name returns the device name, such as etm0 or ete0.
+func (s SysfsSource) Name() string {
+	return s.name
+}
+
+// CPU returns the CPU the ETM traces, or -1 when the snapshot didn't say.
+func (s SysfsSource) CPU() int {
+	return s.cpu
+}
+
+// Protocol returns PROTOCOL_ETE for ete<N> devices and PROTOCOL_ETMV4
+// otherwise.
+func (s SysfsSource) Protocol() Protocol {
+	if strings.HasPrefix(s.name, "ete") {
+		return PROTOCOL_ETE
+	}
+	return PROTOCOL_ETMV4
+}
+
+func (s SysfsSource) TraceID() uint64 {
+	return s.trace_id
+}
+
+func (s SysfsSource) Config() *Config {
+	return s.config
+}
+
+func (s SysfsSource) String() string {
+	return fmt.Sprintf("%s: CPU %d trace ID 0x%x", s.name, s.cpu, s.trace_id)
+}
@@ -1,77 +1,183 @@
 package tracepkts
 
 import (
-	"bufio"
-	"log"
+	"fmt"
 )
 
+// GenericTracePacketv4 holds what every packet shares, the bytes it was
+// decoded from and where they sat in the input stream.
 type GenericTracePacketv4 struct {
-	// header byte
+	header    byte
+	raw       []byte
+	offset    int64
+	timestamp uint64
+	ts_valid  bool
+	context   ETMv4Context
 }
 
 type TracePacket interface {
 	String() string
 }
 
-func DecodePacket(header byte, reader *bufio.Reader) TracePacket {
+// RawPacket is a TracePacket that keeps the bytes it was decoded from.
+type RawPacket interface {
+	TracePacket
+	Raw() []byte
+	Offset() int64
+}
+
+// DecodePacket decodes the packet starting with header, reading any payload
+// from reader.  The header should have been read with reader.ReadHeader so
+// that errors report the packet's offset.
+func DecodePacket(header byte, reader *Reader) (TracePacket, error) {
 	var pkt TracePacket
+	var err error
 	switch {
+	case header >= 0xa0 && header <= 0xaf && !reader.Config().QEnabled():
+		err = reserved(reader, header)
+	case header >= 0x40 && header <= 0x6f && !reader.Config().CondEnabled():
+		err = reserved(reader, header)
 	case header == 0x00:
 		next_byte, err := reader.Peek(1)
 		if err != nil {
-			log.Println("Malformed extended packet, next byte doesn't exist!")
-			return nil
+			return nil, truncated(reader, header, "Extension", err)
 		}
 		switch next_byte[0] {
 		case 0x00:
 			// Continue reading Async
-			pkt = DecodeAsync(header, reader)
+			pkt, err = DecodeAsync(header, reader)
+		case 0x03:
+			// Discard
+			pkt, err = DecodeDiscard(header, reader)
 		case 0x05:
 			// Overflow
-			pkt = DecodeOverflow(header, reader)
+			pkt, err = DecodeOverflow(header, reader)
+		default:
+			err = malformed(reader, header, "Extension", fmt.Sprintf("unknown extension 0x%02x", next_byte[0]))
 		}
+		return pkt, err
 	case header == 0x01:
-		pkt = DecodeTraceInfo(header, reader)
+		pkt, err = DecodeTraceInfo(header, reader)
 	case header >= 0x02 && header <= 0x03:
-		pkt = DecodeTimestamp(header, reader)
+		pkt, err = DecodeTimestamp(header, reader)
 	case header == 0x04:
-		pkt = DecodeTraceOn(header, reader)
+		pkt, err = DecodeTraceOn(header, reader)
+	case header == 0x05:
+		pkt, err = DecodeFunctionReturn(header, reader)
 	case header == 0x06:
-		pkt = DecodeException(header, reader)
+		pkt, err = DecodeException(header, reader)
 	case header == 0x07:
-		pkt = DecodeExceptionReturn(header, reader)
+		pkt, err = DecodeExceptionReturn(header, reader)
 	case header >= 0x0c && header <= 0x0d:
-		pkt = DecodeCycleCountFmt2(header, reader)
+		pkt, err = DecodeCycleCountFmt2(header, reader)
 	case header >= 0x0e && header <= 0x0f:
-		pkt = DecodeCycleCountFmt1(header, reader)
+		pkt, err = DecodeCycleCountFmt1(header, reader)
 	case header >= 0x10 && header <= 0x1f:
-		pkt = DecodeCycleCountFmt3(header, reader)
+		pkt, err = DecodeCycleCountFmt3(header, reader)
+	case header >= 0x20 && header <= 0x27:
+		pkt, err = DecodeNumDataSync(header, reader)
+	case header >= 0x28 && header <= 0x2c:
+		pkt, err = DecodeUnnumDataSync(header, reader)
 	case header == 0x2d:
-		pkt = DecodeCommit(header, reader)
+		pkt, err = DecodeCommit(header, reader)
+	case header >= 0x2e && header <= 0x2f:
+		pkt, err = DecodeCancelFmt1(header, reader)
+	case header >= 0x30 && header <= 0x33:
+		pkt, err = DecodeMispredict(header, reader)
+	case header >= 0x34 && header <= 0x37:
+		pkt, err = DecodeCancelFmt2(header, reader)
+	case header >= 0x38 && header <= 0x3f:
+		pkt, err = DecodeCancelFmt3(header, reader)
+	case header >= 0x40 && header <= 0x42:
+		pkt, err = DecodeCondInstFmt2(header, reader)
+	case header == 0x43:
+		pkt, err = DecodeCondFlush(header, reader)
+	case header >= 0x44 && header <= 0x46:
+		pkt, err = DecodeCondResultFmt4(header, reader)
+	case (header >= 0x48 && header <= 0x4a) || (header >= 0x4c && header <= 0x4e):
+		pkt, err = DecodeCondResultFmt2(header, reader)
+	case header >= 0x50 && header <= 0x5f:
+		pkt, err = DecodeCondResultFmt3(header, reader)
+	case (header >= 0x68 && header <= 0x6b) || (header >= 0x6e && header <= 0x6f):
+		pkt, err = DecodeCondResultFmt1(header, reader)
+	case header == 0x6c:
+		pkt, err = DecodeCondInstFmt1(header, reader)
+	case header == 0x6d:
+		pkt, err = DecodeCondInstFmt3(header, reader)
+	case header == 0x70:
+		pkt, err = DecodeIgnore(header, reader)
 	case header >= 0x71 && header <= 0x7f:
-		pkt = DecodeEvent(header, reader)
+		pkt, err = DecodeEvent(header, reader)
 	case header >= 0x80 && header <= 0x81:
-		pkt = DecodeContext(header, reader)
+		pkt, err = DecodeContext(header, reader)
 	case header >= 0x90 && header <= 0x93:
-		pkt = DecodeExactAddr(header, reader)
+		pkt, err = DecodeExactAddr(header, reader)
 	case header >= 0x95 && header <= 0x96:
-		pkt = DecodeShortAddr(header, reader)
+		pkt, err = DecodeShortAddr(header, reader)
 	case header >= 0x9a && header <= 0x9b:
-		pkt = DecodeLong32b(header, reader)
+		pkt, err = DecodeLong32b(header, reader)
 	case header >= 0x9d && header <= 0x9e:
-		pkt = DecodeLong64b(header, reader)
+		pkt, err = DecodeLong64b(header, reader)
+	case header >= 0xa0 && header <= 0xaf:
+		pkt, err = DecodeQ(header, reader)
 	case header >= 0xf6 && header <= 0xf7:
-		pkt = DecodeAtomFmt1(header, reader)
+		pkt, err = DecodeAtomFmt1(header, reader)
 	case header >= 0xd8 && header <= 0xdb:
-		pkt = DecodeAtomFmt2(header, reader)
+		pkt, err = DecodeAtomFmt2(header, reader)
 	case header >= 0xf8 && header <= 0xff:
-		pkt = DecodeAtomFmt3(header, reader)
+		pkt, err = DecodeAtomFmt3(header, reader)
 	case header >= 0xdc && header <= 0xdf:
-		pkt = DecodeAtomFmt4(header, reader)
-	case (header >= 0xd4 && header <= 0xd7) || header == 0xf5:
-		pkt = DecodeAtomFmt5(header, reader)
-	case header>>6 == 0x3 && (header&0x1f >= 0 || header&0x1f <= 0x14):
-		pkt = DecodeAtomFmt6(header, reader)
+		pkt, err = DecodeAtomFmt4(header, reader)
+	case (header >= 0xd5 && header <= 0xd7) || header == 0xf5:
+		pkt, err = DecodeAtomFmt5(header, reader)
+	case header>>6 == 0x3 && header&0x1f <= 0x14:
+		pkt, err = DecodeAtomFmt6(header, reader)
+	default:
+		err = reserved(reader, header)
+	}
+	return pkt, err
+}
+
+// Header returns the header byte the packet was decoded from.
+func (g *GenericTracePacketv4) Header() byte {
+	if g == nil {
+		return 0
+	}
+	return g.header
+}
+
+// Raw returns every byte of the packet, header included, or nil for a packet
+// that wasn't decoded from a stream.
+func (g *GenericTracePacketv4) Raw() []byte {
+	if g == nil {
+		return nil
+	}
+	return g.raw
+}
+
+// Offset returns the absolute offset of the packet header in the input.
+func (g *GenericTracePacketv4) Offset() int64 {
+	if g == nil {
+		return -1
+	}
+	return g.offset
+}
+
+// CurrentTimestamp returns the full timestamp in effect at the packet, as
+// reconstructed by a Decoder, or false when no Timestamp has been seen since
+// the last Trace Info.
+func (g *GenericTracePacketv4) CurrentTimestamp() (uint64, bool) {
+	if g == nil {
+		return 0, false
+	}
+	return g.timestamp, g.ts_valid
+}
+
+// CurrentContext returns the PE context in effect at the packet, as tracked
+// by a Decoder.
+func (g *GenericTracePacketv4) CurrentContext() ETMv4Context {
+	if g == nil {
+		return ETMv4Context{}
 	}
-	return pkt
+	return g.context
 }